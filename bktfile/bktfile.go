@@ -4,24 +4,41 @@ package bktfile
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"sync"
 	"time"
 )
 
+// 文件头。1.0版本开始桶的个数和索引是64位的，文件中按这个结构存放；0.x版本按fileHeader0存放
 type FileHeader struct {
 	Magic           uint16 // "BF"
 	MajorVersion    uint8  // 主版本号
 	MinorVersion    uint8  // 次版本号
 	HeaderSize      int16  // 文件头部大小
 	BucketSize      int32  // Bucket大小
-	NumberOfBuckets int32  // 文件中Bucket个数
+	NumberOfBuckets int64  // 文件中Bucket个数
 	// 以下两个参数运行过程中可变
-	NumberOfEmptyBuckets int32 // 文件中可用Bucket个数
-	IndexOfEmptyBucket   int32 // 第一个可用空桶位置
+	NumberOfEmptyBuckets int64 // 文件中可用Bucket个数
+	IndexOfEmptyBucket   int64 // 第一个可用空桶位置
+}
+
+// 0.x版本的文件头，桶的个数和索引是32位的
+type fileHeader0 struct {
+	Magic                uint16
+	MajorVersion         uint8
+	MinorVersion         uint8
+	HeaderSize           int16
+	BucketSize           int32
+	NumberOfBuckets      int32
+	NumberOfEmptyBuckets int32
+	IndexOfEmptyBucket   int32
 }
 
 type Bucket struct {
@@ -32,23 +49,99 @@ type Bucket struct {
 
 }
 
+// 桶头扩展部分，紧跟在Bucket之后，直到Bucket.HeaderSize为止。
+// 每一项按 tag(1字节) + 长度(1字节) + 值 的方式存放，不认识的tag直接跳过。
+// 0.1版本的文件没有扩展部分。
+type bucketExt struct {
+	hasChecksum bool
+	checksum    uint32 // 数据部分的CRC32C
+
+	// 链式桶，0.3版本开始支持。头桶记录对象总长度，每个桶记录下一个桶的索引
+	hasChain    bool
+	chainLength int64
+	chainNext   int64
+	chainNext64 bool // chainNext按8字节存放，1.0版本写入的链式桶和索引超过32位的空桶
+
+	// 桶的代数，0.4版本开始支持
+	hasGeneration bool
+	generation    uint32
+
+	// 对象的元数据，只在头桶中。metaSize是元数据区的大小，包括保留的空间
+	meta     []byte
+	metaSize int
+
+	// 数据的压缩方式和压缩前的长度，只在头桶中
+	codec  Codec
+	length int64
+
+	// 加密用的密钥id和nonce，只在头桶中，keyID为0表示没有加密
+	keyID uint32
+	nonce []byte
+
+	// 过期时间，只在头桶中，0表示不过期
+	expires int64
+}
+
+// 内存中的桶头：固定部分加上解析后的扩展部分
+type bucketHeader struct {
+	Bucket
+	ext bucketExt
+}
+
+const (
+	bucketExtChecksum    uint8 = 1
+	bucketExtChainLength uint8 = 2
+	bucketExtChainNext   uint8 = 3
+	bucketExtGeneration  uint8 = 4
+)
+
+// 桶头大小用uint8记录
+const maxBucketHeaderSize = 255
+
+// 各扩展项编码后的大小
+const (
+	sizeOfExtChecksum    = 2 + 4
+	sizeOfExtChainLength = 2 + 8
+	sizeOfExtChainNext   = 2 + 4
+	sizeOfExtGeneration  = 2 + 4
+)
+
+// 数据校验失败，或者桶已经被标记为错误状态
+type CorruptionError struct {
+	Name     string
+	Index    int64
+	Expected uint32
+	Actual   uint32
+	Marked   bool // 桶之前已经标记为错误状态，没有校验和可以比较
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Marked {
+		return fmt.Sprintf("bucket %d of %s is corrupted (bucket marked as error)", e.Index, e.Name)
+	}
+	return fmt.Sprintf("bucket %d of %s is corrupted (checksum %08x, want %08x)", e.Index, e.Name, e.Actual, e.Expected)
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 var defaultFileHeader FileHeader
 var defaultBucket Bucket
 
-var sizeOfFileHeader, sizeOfBucketHeader int
+var sizeOfFileHeader, sizeOfFileHeader0, sizeOfBucketHeader int
 
 var majorVersion, minorVersion uint8
 
 func init() {
 	sizeOfFileHeader = binary.Size(defaultFileHeader)
+	sizeOfFileHeader0 = binary.Size(fileHeader0{})
 	sizeOfBucketHeader = binary.Size(defaultBucket)
-	majorVersion = 0
-	minorVersion = 1
+	majorVersion = 1
+	minorVersion = 0
 }
 
 const (
 	BUCKETFILE_MAGIC      uint16 = 0x4642
-	INVALID_INDEX         int32  = -1
+	INVALID_INDEX         int64  = -1
 	INVALID_LENGTH32      int32  = -1
 	INVALID_LENGTH64      int64  = -1
 	INVALID_POINTER       int64  = -1
@@ -56,16 +149,44 @@ const (
 	BUCKET_STATUS_USED    int8   = 'u'
 	BUCKET_STATUS_DELETED int8   = 'd'
 	BUCKET_STATUS_ERROR   int8   = 'e'
+	BUCKET_STATUS_CHAINED int8   = 'c' // 链式对象的后续桶
 )
 
+// 文件的读写都按位置进行(ReadAt/WriteAt)，不移动共享的文件位置。
+// 读取桶、写入数据部分加读锁，可以并行；修改文件头和桶头、Reopen、Close加写锁。
 type File struct {
 	fh     FileHeader
 	closer io.Closer
 	reader io.ReaderAt
-	writer io.WriteSeeker
-	locker sync.Mutex
+	writer io.WriterAt
+	locker sync.RWMutex
 
 	name string
+
+	// 文件所在的存储，reader、writer和closer都是它
+	storage Storage
+
+	// 压缩期间被修改的桶
+	dirty map[int64]bool
+
+	// 日志，以及正在进行的修改
+	journal *journal
+	tx      *transaction
+
+	// 写入之后的同步方式
+	syncMode SyncMode
+	group    *groupSync
+
+	// 回收桶时是否打洞，以及这次修改中回收的桶
+	punchHoles bool
+	freed      []int64
+
+	// 文件头扩展部分，以及读写加密对象用的密钥
+	ext  fileExt
+	keys *Keyring
+
+	// 打开文件时文件头的恢复情况
+	recovery string
 }
 
 func (h *FileHeader) isValid() bool {
@@ -73,7 +194,7 @@ func (h *FileHeader) isValid() bool {
 		return false
 	}
 
-	if h.MajorVersion > majorVersion || h.MajorVersion > minorVersion {
+	if !h.knownVersion() {
 		return false
 	}
 
@@ -84,10 +205,37 @@ func (h *FileHeader) isValid() bool {
 	return true
 }
 
-func (h *FileHeader) indexToPointer(index int32) int64 {
+func (h *FileHeader) indexToPointer(index int64) int64 {
 	return int64(h.HeaderSize) + int64(index)*int64(h.BucketSize)
 }
 
+// 文件版本不低于major.minor
+func (h *FileHeader) atLeast(major, minor uint8) bool {
+	return h.MajorVersion > major || (h.MajorVersion == major && h.MinorVersion >= minor)
+}
+
+// 0.2版本开始，桶头带有数据校验和
+func (h *FileHeader) hasChecksum() bool {
+	return h.atLeast(0, 2)
+}
+
+// 0.3版本开始，支持一个对象跨多个桶存放
+func (h *FileHeader) hasChain() bool {
+	return h.atLeast(0, 3)
+}
+
+// 按文件版本写入新数据时的桶头大小
+func (h *FileHeader) bucketHeaderSize() int {
+	size := sizeOfBucketHeader
+	if h.hasChecksum() {
+		size += sizeOfExtChecksum
+	}
+	if h.hasGeneration() {
+		size += sizeOfExtGeneration
+	}
+	return size
+}
+
 func (h *FileHeader) isFull() bool {
 	return h.NumberOfEmptyBuckets == 0 || h.IndexOfEmptyBucket == h.NumberOfBuckets
 }
@@ -108,6 +256,10 @@ func (b *Bucket) isError() bool {
 	return b.Status == BUCKET_STATUS_ERROR
 }
 
+func (b *Bucket) isChained() bool {
+	return b.Status == BUCKET_STATUS_CHAINED
+}
+
 func (b *Bucket) setStatus(status int8) {
 	b.Status = status
 }
@@ -120,16 +272,143 @@ func (b *Bucket) dataLength() int32 {
 	}
 }
 
-func (b *Bucket) indexOfNextEmptyBucket() int32 {
-	if b.isEmpty() {
-		return b.DataLength
-	} else {
+// 空桶链表中的下一个空桶。超过32位的索引放在扩展部分的chainNext中
+func (b *bucketHeader) indexOfNextEmptyBucket() int64 {
+	if !b.isEmpty() {
 		return INVALID_INDEX
 	}
+	if b.ext.hasChain {
+		return b.ext.chainNext
+	}
+	return int64(b.DataLength)
+}
+
+func (b *bucketHeader) setIndexOfNextEmptyBucket(index int64) {
+	if index > math.MaxInt32 {
+		b.DataLength = 0
+		b.ext.hasChain, b.ext.chainLength, b.ext.chainNext, b.ext.chainNext64 = true, 0, index, true
+		return
+	}
+	b.DataLength = int32(index)
+	b.ext.hasChain, b.ext.chainLength, b.ext.chainNext, b.ext.chainNext64 = false, 0, 0, false
+}
+
+// 数据部分相对桶起始位置的偏移
+func (b *Bucket) dataOffset() int {
+	if int(b.HeaderSize) < sizeOfBucketHeader {
+		return sizeOfBucketHeader
+	}
+	return int(b.HeaderSize)
 }
 
-func (b *Bucket) setIndexOfNextEmptyBucket(index int32) {
-	b.DataLength = index
+func readBucketHeader(r io.Reader) (*bucketHeader, error) {
+	bucket := new(bucketHeader)
+	if err := binary.Read(r, binary.LittleEndian, &bucket.Bucket); err != nil {
+		return nil, err
+	}
+	extSize := bucket.dataOffset() - sizeOfBucketHeader
+	if extSize == 0 {
+		return bucket, nil
+	}
+	ext := make([]byte, extSize)
+	if _, err := io.ReadFull(r, ext); err != nil {
+		return nil, err
+	}
+	for len(ext) >= 2 {
+		tag, length := ext[0], int(ext[1])
+		if len(ext) < 2+length {
+			return nil, errors.New("Invalid bucket header extension.")
+		}
+		value := ext[2 : 2+length]
+		switch tag {
+		case bucketExtChecksum:
+			if length == 4 {
+				bucket.ext.hasChecksum = true
+				bucket.ext.checksum = binary.LittleEndian.Uint32(value)
+			}
+		case bucketExtChainLength:
+			if length == 8 {
+				bucket.ext.hasChain = true
+				bucket.ext.chainLength = int64(binary.LittleEndian.Uint64(value))
+			}
+		case bucketExtChainNext:
+			if length == 4 {
+				bucket.ext.hasChain = true
+				bucket.ext.chainNext = int64(int32(binary.LittleEndian.Uint32(value)))
+			} else if length == 8 {
+				bucket.ext.hasChain, bucket.ext.chainNext64 = true, true
+				bucket.ext.chainNext = int64(binary.LittleEndian.Uint64(value))
+			}
+		case bucketExtGeneration:
+			if length == 4 {
+				bucket.ext.hasGeneration = true
+				bucket.ext.generation = binary.LittleEndian.Uint32(value)
+			}
+		case bucketExtCodec:
+			parseCodec(bucket, value)
+		case bucketExtCipher:
+			parseCipher(bucket, value)
+		case bucketExtExpires:
+			parseExpires(bucket, value)
+		case bucketExtMeta:
+			bucket.ext.meta = append([]byte(nil), value...)
+			bucket.ext.metaSize += 2 + length
+		case bucketExtPadding:
+			bucket.ext.metaSize += 2 + length
+		}
+		ext = ext[2+length:]
+	}
+	// 元数据区最后可能有1字节放不下填充项
+	if bucket.ext.metaSize > 0 {
+		bucket.ext.metaSize += len(ext)
+	}
+	return bucket, nil
+}
+
+// 将桶头编码为字节，同时更新HeaderSize
+func (b *bucketHeader) encode() []byte {
+	var ext []byte
+	if b.ext.hasChecksum {
+		ext = append(ext, bucketExtChecksum, 4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(ext[len(ext)-4:], b.ext.checksum)
+	}
+	if b.ext.hasChain {
+		if b.ext.chainLength > 0 {
+			ext = append(ext, bucketExtChainLength, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(ext[len(ext)-8:], uint64(b.ext.chainLength))
+		}
+		if b.ext.chainNext64 || b.ext.chainNext > math.MaxInt32 {
+			ext = append(ext, bucketExtChainNext, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(ext[len(ext)-8:], uint64(b.ext.chainNext))
+		} else {
+			ext = append(ext, bucketExtChainNext, 4, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(ext[len(ext)-4:], uint32(b.ext.chainNext))
+		}
+	}
+	if b.ext.hasGeneration {
+		ext = append(ext, bucketExtGeneration, 4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(ext[len(ext)-4:], b.ext.generation)
+	}
+	ext = b.encodeCodec(ext)
+	ext = b.encodeCipher(ext)
+	ext = b.encodeExpires(ext)
+	if b.ext.metaSize > 0 {
+		// 元数据区放在最后，剩下的空间用填充项占住
+		ext = append(ext, bucketExtMeta, uint8(len(b.ext.meta)))
+		ext = append(ext, b.ext.meta...)
+		if padding := b.ext.metaSize - 2 - len(b.ext.meta); padding >= 2 {
+			ext = append(ext, bucketExtPadding, uint8(padding-2))
+			ext = append(ext, make([]byte, padding-2)...)
+		} else if padding == 1 {
+			ext = append(ext, 0)
+		}
+	}
+	b.HeaderSize = uint8(sizeOfBucketHeader + len(ext))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, b.Bucket)
+	buf.Write(ext)
+	return buf.Bytes()
 }
 
 const (
@@ -137,42 +416,59 @@ const (
 	OF_RDWR   = os.O_RDWR
 )
 
-// 创建一个指定桶大小，桶个数的桶文件
-func CreateFile(name string, perm os.FileMode, bucketSize int32, numberOfBuckets int32) (*File, error) {
+// 创建一个指定桶大小，桶个数的桶文件，文件加排他锁
+func CreateFile(name string, perm os.FileMode, bucketSize int32, numberOfBuckets int64) (*File, error) {
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
 	if err != nil {
 		return nil, err
 	}
+	if err := lockFile(f, true); err != nil {
+		f.Close()
+		return nil, err
+	}
+	bf, err := New(f, bucketSize, numberOfBuckets)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return bf, nil
+}
+
+// 在空的存储中创建一个指定桶大小，桶个数的桶文件。存储需要能改变大小
+func New(s Storage, bucketSize int32, numberOfBuckets int64) (*File, error) {
+	truncater, ok := s.(interface {
+		Truncate(size int64) error
+	})
+	if !ok {
+		return nil, errors.New("Storage can not be resized.")
+	}
 	bf := new(File)
-	bf.name = name
+	bf.name = storageName(s)
 	bf.fh = FileHeader{
 		BUCKETFILE_MAGIC,
 		majorVersion,
 		minorVersion,
-		int16(sizeOfFileHeader),
+		int16(fileHeaderSize),
 		bucketSize,
 		numberOfBuckets,
 		numberOfBuckets,
 		0,
 	}
 
-	fileSize := int64(bucketSize)*int64(numberOfBuckets) + int64(bf.fh.HeaderSize)
-	if err := f.Truncate(fileSize); err != nil {
-		f.Close()
+	if err := truncater.Truncate(bf.fh.fileSize()); err != nil {
 		return nil, err
 	}
 
-	if err = binary.Write(f, binary.LittleEndian, bf.fh); err != nil {
-		f.Close()
+	bf.storage = s
+	bf.writer, bf.reader, bf.closer = s, s, s
+	if err := bf.flushHead(); err != nil {
 		return nil, err
 	}
 
-	bf.writer, bf.reader, bf.closer = f, f, f
-
 	return bf, nil
 }
 
-// 打开一个桶文件进行读或者写
+// 打开一个桶文件进行读或者写。读写打开加排他锁，只读打开加共享锁，加不上锁时返回*LockError
 func OpenFile(name string, flag int) (*File, error) {
 	f, err := os.OpenFile(name, flag, 0000)
 	if err != nil {
@@ -185,72 +481,192 @@ func OpenFile(name string, flag int) (*File, error) {
 		}
 	}()
 
+	// 日志也由这个锁保护，加锁之后才能重做
+	if err := lockFile(f, (flag&OF_RDWR) == OF_RDWR); err != nil {
+		return nil, err
+	}
+
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	bf := new(File)
-	if fi.Size() < int64(sizeOfFileHeader) {
+	if fi.Size() < int64(sizeOfFileHeader0) {
 		return nil, errors.New("Invalid file length.")
 	}
 
-	if err := binary.Read(f, binary.LittleEndian, &bf.fh); err != nil {
+	// 有日志时先重做日志中的修改，再读文件头
+	jname := journalName(name)
+	jf, err := os.OpenFile(jname, flag, 0000)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-
-	if !bf.fh.isValid() {
-		return nil, errors.New("Not a valid bucket file")
+	var txs []*transaction
+	if jf != nil {
+		defer func() {
+			if jf != nil {
+				jf.Close()
+			}
+		}()
+		txs = readJournal(jf)
+		if len(txs) > 0 {
+			if (flag & OF_RDWR) != OF_RDWR {
+				return nil, errors.New("Journal needs to be replayed, open the file for writing.")
+			}
+			if err := replayJournal(f, txs); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	bf.reader = f
-	bf.closer = f
-	if (flag & OF_RDWR) == OF_RDWR {
-		bf.writer = f
+	bf, err := openStorage(f, flag)
+	if err != nil {
+		return nil, err
 	}
 	bf.name = name
 
+	if jf != nil && bf.writer != nil {
+		bf.journal = &journal{name: jname, file: jf, pending: make(map[int64][]int64)}
+		jf = nil
+		if err := bf.recover(txs); err != nil {
+			bf.journal.file.Close()
+			return nil, err
+		}
+	}
+
 	f = nil
 	return bf, nil
 }
 
-func (f *File) Reopen(flag int) error {
-	name := f.Name()
+// 打开存储中的桶文件进行读写
+func Open(s Storage) (*File, error) {
+	return openStorage(s, OF_RDWR)
+}
+
+func openStorage(s Storage, flag int) (*File, error) {
+	size, err := storageSize(s)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(sizeOfFileHeader0) {
+		return nil, errors.New("Invalid file length.")
+	}
+
+	bf := new(File)
+	bf.storage = s
+	bf.reader = s
+	bf.closer = s
+	if (flag & OF_RDWR) == OF_RDWR {
+		bf.writer = s
+	}
+	bf.name = storageName(s)
 
+	if err := bf.readHeader(size); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+func (f *File) Reopen(flag int) error {
 	defer f.locker.Unlock()
 	f.locker.Lock()
-	f.Close()
 
-	file, err := OpenFile(name, flag)
+	name, storage := f.name, f.storage
+	f.close()
+
+	// 操作系统中的文件按名字重新打开，其他存储重新读取
+	var file *File
+	var err error
+	if _, ok := storage.(*os.File); ok || storage == nil {
+		file, err = OpenFile(name, flag)
+	} else {
+		file, err = openStorage(storage, flag)
+	}
 	if err != nil {
 		return err
 	}
 	f.fh = file.fh
+	f.ext = file.ext
+	f.recovery = file.recovery
 	f.reader = file.reader
 	f.writer = file.writer
 	f.closer = file.closer
+	f.storage = file.storage
+	f.journal = file.journal
 	f.name = name
 
 	return nil
 }
 
-func (f *File) readBucket(pointerToBucket int64) (*Bucket, error) {
-	bucket := new(Bucket)
-	sr := bufio.NewReader(io.NewSectionReader(f.reader, pointerToBucket, int64(f.fh.BucketSize)))
-	if err := binary.Read(sr, binary.LittleEndian, bucket); err != nil {
-		return nil, err
+// 读取指定桶的桶头
+func (f *File) bucketAt(index int64) (*bucketHeader, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if f.reader == nil {
+		return nil, errors.New("File is not readable")
 	}
-	return bucket, nil
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return nil, errors.New("Index overflows")
+	}
+	return f.readBucket(f.fh.indexToPointer(index))
+}
+
+// 只读取桶头，不读数据，调用者已经加锁
+func (f *File) readBucket(pointerToBucket int64) (*bucketHeader, error) {
+	size := int64(f.fh.BucketSize)
+	if size > maxBucketHeaderSize {
+		size = maxBucketHeaderSize
+	}
+	sr := bufio.NewReaderSize(io.NewSectionReader(f.reader, pointerToBucket, size), int(size))
+	return readBucketHeader(sr)
+}
+
+// 修改过程中读取桶头，能读到这次修改中已经写过的桶头。调用者已经加锁
+func (f *File) readMeta(pointerToBucket int64) (*bucketHeader, error) {
+	if f.tx != nil {
+		if data, ok := f.tx.lookup(pointerToBucket); ok {
+			return readBucketHeader(bytes.NewReader(data))
+		}
+	}
+	return f.readBucket(pointerToBucket)
+}
+
+func (f *File) writeBucket(pointerToBucket int64, bucket *bucketHeader) error {
+	return f.writeMeta(pointerToBucket, bucket.encode())
+}
+
+// 写文件头或者桶头。使用日志时记入正在进行的修改，不在修改过程中则单独提交。调用者已经加锁
+func (f *File) writeMeta(pointer int64, data []byte) error {
+	if f.journal == nil {
+		return f.writeDirect(pointer, data)
+	}
+	if f.tx != nil {
+		f.tx.add(pointer, data)
+		return nil
+	}
+	f.begin()
+	f.tx.add(pointer, data)
+	return f.commit()
+}
+
+func (f *File) writeDirect(pointer int64, data []byte) error {
+	_, err := f.writer.WriteAt(data, pointer)
+	return err
 }
 
-// 返回数据，写入时间，或者错误
-func (f *File) readData(pointerToBucket int64) ([]byte, int64, error) {
+// 返回数据，写入时间，或者错误。generation不为0时检查代数。调用者已经加读锁
+func (f *File) readData(index int64, generation uint32) ([]byte, int64, error) {
 	if f.reader == nil {
 		return nil, 0, errors.New("File is not readable")
 	}
-	var bucket Bucket
+	pointerToBucket := f.fh.indexToPointer(index)
 	sr := bufio.NewReader(io.NewSectionReader(f.reader, pointerToBucket, int64(f.fh.BucketSize)))
-	if err := binary.Read(sr, binary.LittleEndian, &bucket); err != nil {
+	bucket, err := readBucketHeader(sr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := bucket.checkGeneration(generation); err != nil {
 		return nil, 0, err
 	}
 	// it's a empty bucket
@@ -258,178 +674,234 @@ func (f *File) readData(pointerToBucket int64) ([]byte, int64, error) {
 		return nil, 0, nil
 	}
 
+	if bucket.isError() {
+		return nil, 0, &CorruptionError{Name: f.name, Index: index, Marked: true}
+	}
+
 	if bucket.isUsed() {
-		if bucket.DataLength > f.fh.BucketSize-int32(bucket.HeaderSize) {
+		if err := bucket.checkExpires(); err != nil {
+			return nil, 0, err
+		}
+		if bucket.DataLength < 0 || bucket.DataLength > f.fh.BucketSize-int32(bucket.dataOffset()) {
 			return nil, 0, errors.New("Invalid bucket data size.")
 		}
+		if bucket.ext.hasChain {
+			return f.readChain(index, bucket, sr)
+		}
 		data := make([]byte, bucket.DataLength)
-		if _, err := sr.Read(data); err != nil {
+		if _, err := io.ReadFull(sr, data); err != nil {
+			return nil, 0, err
+		}
+		if err := f.verify(index, bucket, data); err != nil {
+			return nil, 0, err
+		}
+		if data, err = f.decode(bucket, data); err != nil {
 			return nil, 0, err
-		} else {
-			return data, bucket.TimeStamp, nil
 		}
+		return data, bucket.TimeStamp, nil
 	} else {
 		return nil, 0, nil
 	}
 }
 
+// 校验桶中的数据。失败时返回CorruptionError，由调用者在释放读锁之后调用markError
+func (f *File) verify(index int64, bucket *bucketHeader, data []byte) error {
+	if !bucket.ext.hasChecksum {
+		return nil
+	}
+	if sum := crc32.Checksum(data, castagnoli); sum != bucket.ext.checksum {
+		return &CorruptionError{Name: f.name, Index: index, Expected: bucket.ext.checksum, Actual: sum}
+	}
+	return nil
+}
+
+// 将校验失败的桶标记为错误状态。只读打开的文件不做标记。
+// 校验之后桶可能已经被回收或者重新写入，只有校验和仍然相同时才标记
+func (f *File) markError(err error) {
+	ce, ok := err.(*CorruptionError)
+	if !ok || ce.Expected == ce.Actual {
+		return
+	}
+
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil || ce.Index < 0 || ce.Index >= f.fh.NumberOfBuckets {
+		return
+	}
+	pointerToBucket := f.fh.indexToPointer(ce.Index)
+	bucket, err := f.readBucket(pointerToBucket)
+	if err != nil || !(bucket.isUsed() || bucket.isChained()) || bucket.ext.checksum != ce.Expected {
+		return
+	}
+	bucket.setStatus(BUCKET_STATUS_ERROR)
+	f.writeBucket(pointerToBucket, bucket)
+}
+
 func (f *File) FileHeader() FileHeader {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
 	return f.fh
 }
 
 func (f *File) Name() string {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
 	return f.name
 }
 
 func (f *File) IsFull() bool {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
 	return f.fh.NumberOfEmptyBuckets == 0
 }
 
 func (f *File) flushHead() error {
-	if _, err := f.writer.Seek(0, 0); err != nil {
-		return err
+	if f.fh.hasHeaderCopy() {
+		return f.flushHeader()
 	}
-	if err := binary.Write(f.writer, binary.LittleEndian, f.fh); err != nil {
-		return err
-	}
-	return nil
+	return f.writeMeta(0, f.fh.encode())
 }
 
 // 从指定桶读取数据并返回。如果是空桶，则返回空。
-func (f *File) Read(index int32) ([]byte, int64, error) {
-	if index >= f.fh.NumberOfBuckets {
+func (f *File) Read(index int64) ([]byte, int64, error) {
+	return f.ReadObject(index, 0)
+}
+
+func (f *File) read(index int64, generation uint32) ([]byte, int64, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if index < 0 || index >= f.fh.NumberOfBuckets {
 		return nil, 0, errors.New("Index overflows")
 	}
-	return f.readData(f.fh.indexToPointer(index))
+	return f.readData(index, generation)
 }
 
 // 将len(data)的数据写入一个空桶。如果数据大小大于桶可以容纳的数据大小则失败
-func (f *File) Write(data []byte) (int32, error) {
-	dataLength := len(data)
-	if dataLength > int(f.fh.BucketSize)-int(sizeOfBucketHeader) {
-		return -1, errors.New("Data is too long.")
-	}
-
-	if f.writer == nil {
-		return -1, errors.New("File not writealbe.")
-	}
+func (f *File) Write(data []byte) (int64, error) {
+	index, _, err := f.write(bytes.NewReader(data), int64(len(data)), false, 0, headExt{})
+	return index, err
+}
 
-	if f.fh.isFull() {
-		return -1, errors.New("Bucket file is full.")
-	}
+// 清空回收指定索引的桶
+func (f *File) Empty(index int64) error {
+	return f.EmptyObject(index, 0)
+}
 
+// 和Empty一样回收对象，generation不为0时先检查桶的代数
+func (f *File) EmptyObject(index int64, generation uint32) error {
 	defer f.locker.Unlock()
 	f.locker.Lock()
 
-	pointToEmptyBucket := f.fh.indexToPointer(f.fh.IndexOfEmptyBucket)
-	bucket, err := f.readBucket(pointToEmptyBucket)
-	if err != nil {
-		return -1, err
-	}
-	if !bucket.isEmpty() {
-		return -1, errors.New("Empty bucket wanted, but nonempty bucket found.")
-	}
-
-	indexOfNextEmptyBucket := bucket.indexOfNextEmptyBucket()
-	if indexOfNextEmptyBucket == 0 {
-		indexOfNextEmptyBucket = f.fh.IndexOfEmptyBucket + 1
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return errors.New("Index overflows.")
 	}
-
-	bucket.setStatus(BUCKET_STATUS_USED)
-	bucket.DataLength = int32(dataLength)
-	bucket.TimeStamp = time.Now().Unix()
-	bucket.HeaderSize = uint8(sizeOfBucketHeader)
-
-	indexOfThisBucket := f.fh.IndexOfEmptyBucket
-	pointToThisBucket := f.fh.indexToPointer(indexOfThisBucket)
-
-	// 写文件头，如果桶写失败，最多这个桶就废了，不至于文件坏掉
-	if _, err = f.writer.Seek(0, 0); err != nil {
-		return -1, err
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
 	}
-
-	f.fh.IndexOfEmptyBucket = indexOfNextEmptyBucket
-	f.fh.NumberOfEmptyBuckets--
-
-	defer func() {
-		// 如果头或者桶写失败，头部索引先回滚。至少保证文件关闭前，当前写失败的桶还能继续使用。
+	if generation != 0 {
+		bucket, err := f.readMeta(f.fh.indexToPointer(index))
 		if err != nil {
-			f.fh.IndexOfEmptyBucket = indexOfThisBucket
-			f.fh.NumberOfEmptyBuckets++
+			return err
+		}
+		if err := bucket.checkGeneration(generation); err != nil {
+			return err
 		}
-	}()
-
-	if err = binary.Write(f.writer, binary.LittleEndian, f.fh); err != nil {
-		return -1, err
-	}
-
-	// 先写桶和数据
-	if _, err = f.writer.Seek(pointToThisBucket, 0); err != nil {
-		return -1, err
-	}
-	bufwriter := bufio.NewWriter(f.writer)
-	if err = binary.Write(bufwriter, binary.LittleEndian, *bucket); err != nil {
-		return -1, err
-	}
-	if _, err = bufwriter.Write(data); err != nil {
-		return -1, err
-	}
-	if err = bufwriter.Flush(); err != nil {
-		return -1, err
 	}
 
-	return indexOfThisBucket, nil
+	f.begin()
+	return f.end(f.empty(index))
 }
 
-// 清空回收指定索引的桶
-func (f *File) Empty(index int32) error {
-	if index >= f.fh.NumberOfBuckets {
-		return errors.New("Index overflows.")
-	}
-
-	defer f.locker.Unlock()
-	f.locker.Lock()
+// 回收指定索引的桶，调用者已经加锁
+func (f *File) empty(index int64) error {
+	f.touch(index)
 
 	pointerToBucket := f.fh.indexToPointer(index)
-	bucket, err := f.readBucket(pointerToBucket)
+	bucket, err := f.readMeta(pointerToBucket)
 	if err != nil {
 		return err
 	}
 
+	if bucket.isChained() {
+		return errors.New("Not the head bucket of a chain.")
+	}
+
+	// 空桶也可能有chainNext，存放的是下一个空桶
+	if bucket.ext.hasChain && !bucket.isEmpty() {
+		return f.emptyChain(index, bucket)
+	}
+
 	if !bucket.isEmpty() {
-		bucket.setIndexOfNextEmptyBucket(f.fh.IndexOfEmptyBucket)
-		bucket.setStatus(BUCKET_STATUS_EMPTY)
 		bucket.TimeStamp = time.Now().Unix()
-		bucket.HeaderSize = uint8(sizeOfBucketHeader)
+		if err = f.pushEmptyBucket(index, bucket); err != nil {
+			return err
+		}
+		return f.flushHead()
+	}
+	return nil
+}
+
+// 把桶放回空桶链表，调用者已经加锁，并负责写文件头。桶的代数保留下来，下次使用时继续增加。
+// 空桶的下一个索引为0表示紧接着的下一个桶(新文件中从未写过的桶)，
+// 所以链表头是0号桶时，回收的桶插在0号桶后面，避免记录下一个索引为0。
+func (f *File) pushEmptyBucket(index int64, bucket *bucketHeader) error {
+	bucket.setStatus(BUCKET_STATUS_EMPTY)
+	bucket.ext = bucketExt{hasGeneration: bucket.ext.hasGeneration, generation: bucket.ext.generation}
+	f.free(index)
 
-		if _, err = f.writer.Seek(pointerToBucket, 0); err != nil {
+	if f.fh.IndexOfEmptyBucket == 0 && f.fh.NumberOfEmptyBuckets > 0 && index != 0 {
+		first, err := f.readMeta(f.fh.indexToPointer(0))
+		if err != nil {
 			return err
 		}
-		if err = binary.Write(f.writer, binary.LittleEndian, bucket); err != nil {
+		next := first.indexOfNextEmptyBucket()
+		if next == 0 {
+			next = 1
+		}
+		bucket.setIndexOfNextEmptyBucket(next)
+		if err := f.writeBucket(f.fh.indexToPointer(index), bucket); err != nil {
 			return err
 		}
-
-		f.fh.NumberOfEmptyBuckets++
-		f.fh.IndexOfEmptyBucket = index
-
-		if _, err = f.writer.Seek(0, 0); err != nil {
+		first.setIndexOfNextEmptyBucket(index)
+		if err := f.writeBucket(f.fh.indexToPointer(0), first); err != nil {
 			return err
 		}
-
-		if err = binary.Write(f.writer, binary.LittleEndian, f.fh); err != nil {
+	} else {
+		bucket.setIndexOfNextEmptyBucket(f.fh.IndexOfEmptyBucket)
+		if err := f.writeBucket(f.fh.indexToPointer(index), bucket); err != nil {
 			return err
 		}
+		f.fh.IndexOfEmptyBucket = index
 	}
+	f.fh.NumberOfEmptyBuckets++
 	return nil
 }
 
 // 关闭文件
 func (f *File) Close() error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	return f.close()
+}
+
+func (f *File) close() error {
 	defer func() {
 		f.fh = defaultFileHeader
 		f.writer, f.reader, f.closer = nil, nil, nil
+		f.storage = nil
+		f.journal = nil
 		f.name = ""
 	}()
+	if f.journal != nil {
+		f.checkpoint()
+		f.journal.file.Close()
+	}
 	if f.closer != nil {
 		return f.closer.Close()
 	} else {
@@ -2,10 +2,20 @@ package bktfile
 
 import (
 	//	"files"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	//"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var testPath string
@@ -105,14 +115,14 @@ func TestRoutineWrite(t *testing.T) {
 }
 
 func emptyDataRoutine(t *testing.T, f *File, index int, c chan int) {
-	i := int32(index*32 + 3)
+	i := int64(index*32 + 3)
 	f.Empty(i)
 	t.Logf("bucket %d is emptyed\n", i)
 	c <- index
 }
 
 func writeDataRoutine(t *testing.T, f *File, index int, c chan int) {
-	var bkIndex int32
+	var bkIndex int64
 	for i := 1; i < 256; i++ {
 		bkIndex, _ = f.Write([]byte(fmt.Sprintf(mtrlFmt, i, index)))
 		t.Logf("routine(%d) write bucket index: %d\n", index, bkIndex)
@@ -120,3 +130,1740 @@ func writeDataRoutine(t *testing.T, f *File, index int, c chan int) {
 	t.Logf("routine %d finished\n", index)
 	c <- index
 }
+
+func TestChecksum(t *testing.T) {
+	name := testPath + "testChecksum.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	i, err := f.Write([]byte(mtrl1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _, err := f.Read(i); err != nil || string(d) != mtrl1 {
+		t.Fatalf("read back failed: %q, %v", d, err)
+	}
+
+	// 改掉数据部分的一个字节
+	fh := f.FileHeader()
+	p := fh.indexToPointer(i) + int64(fh.bucketHeaderSize())
+	if _, err := f.writer.WriteAt([]byte("X"), p); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = f.Read(i)
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Fatalf("CorruptionError wanted, got %v", err)
+	}
+	b, err := f.readBucket(fh.indexToPointer(i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.isError() {
+		t.Errorf("bucket status %c, want 'e'", b.Status)
+	}
+
+	// 再次读取时桶已经是错误状态
+	_, _, err = f.Read(i)
+	if e, ok := err.(*CorruptionError); !ok || !e.Marked || !strings.Contains(e.Error(), "marked as error") {
+		t.Errorf("marked CorruptionError wanted, got %v", err)
+	}
+}
+
+func TestReadVersion01(t *testing.T) {
+	name := testPath + "testVersion01.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.fh.MajorVersion, f.fh.MinorVersion = 0, 1
+	if err := f.flushHead(); err != nil {
+		t.Fatal(err)
+	}
+	i, err := f.Write([]byte(mtrl1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = OpenFile(name, OF_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b, err := f.readBucket(f.fh.indexToPointer(i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(b.HeaderSize) != sizeOfBucketHeader || b.ext.hasChecksum {
+		t.Errorf("version 0.1 bucket should not carry a checksum")
+	}
+	if d, _, err := f.Read(i); err != nil || string(d) != mtrl1 {
+		t.Errorf("read back failed: %q, %v", d, err)
+	}
+}
+
+func TestWriteChained(t *testing.T) {
+	name := testPath + "testChained.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := f.Write(data); err == nil {
+		t.Fatal("Write should refuse data larger than a bucket")
+	}
+
+	f.Write([]byte(mtrl1))
+	index, err := f.WriteChained(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := f.BucketsFor(int64(len(data)))
+	if empty := f.FileHeader().NumberOfEmptyBuckets; empty != 64-1-n {
+		t.Errorf("%d empty buckets, want %d", empty, 64-1-n)
+	}
+
+	d, _, err := f.Read(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != string(data) {
+		t.Fatal("chained data is not matched")
+	}
+	if d, _, err := f.Read(index + 1); err != nil || d != nil {
+		t.Errorf("reading a chained bucket directly should return nothing: %v, %v", d, err)
+	}
+	if err := f.Empty(index + 1); err == nil {
+		t.Errorf("Empty should refuse a chained bucket")
+	}
+
+	if err := f.Empty(index); err != nil {
+		t.Fatal(err)
+	}
+	if empty := f.FileHeader().NumberOfEmptyBuckets; empty != 64-1 {
+		t.Errorf("%d empty buckets after Empty, want %d", empty, 64-1)
+	}
+
+	// 回收的桶可以再次使用
+	if index, err = f.WriteChained(data); err != nil {
+		t.Fatal(err)
+	}
+	if d, _, err := f.Read(index); err != nil || string(d) != string(data) {
+		t.Errorf("chained data is not matched after reuse: %v", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	name := testPath + "testTrash.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	i, _ := f.Write([]byte(mtrl1))
+	if err := f.Purge(i); err == nil {
+		t.Error("Purge should refuse a bucket not in trash")
+	}
+	if err := f.Delete(i); err != nil {
+		t.Fatal(err)
+	}
+	if d, _, err := f.Read(i); err != nil || d != nil {
+		t.Errorf("deleted bucket should read as nothing: %q, %v", d, err)
+	}
+	if indexes, err := f.Deleted(); err != nil || len(indexes) != 1 || indexes[0] != i {
+		t.Errorf("Deleted() = %v, %v", indexes, err)
+	}
+
+	if err := f.Restore(i); err != nil {
+		t.Fatal(err)
+	}
+	if d, _, err := f.Read(i); err != nil || string(d) != mtrl1 {
+		t.Errorf("restored bucket is not matched: %q, %v", d, err)
+	}
+
+	f.Delete(i)
+	if n, err := f.PurgeDeleted(0); err != nil || n != 0 {
+		t.Errorf("nothing should be purged before the retention: %d, %v", n, err)
+	}
+	if n, err := f.PurgeDeleted(time.Now().Unix() + 1); err != nil || n != 1 {
+		t.Errorf("PurgeDeleted() = %d, %v", n, err)
+	}
+	if empty := f.FileHeader().NumberOfEmptyBuckets; empty != 16 {
+		t.Errorf("%d empty buckets after purge, want 16", empty)
+	}
+	if err := f.Restore(i); err == nil {
+		t.Error("purged bucket should not be restorable")
+	}
+
+	// 扫描之后恢复又重新删除的桶，删除时间不在before之前，不回收
+	i, _ = f.Write([]byte(mtrl1))
+	before := time.Now().Unix()
+	f.setDeleted(i, true, before-10, 0)
+	f.Restore(i)
+	f.setDeleted(i, true, before+10, 0)
+	if err := f.purge(i, 0, before); err == nil {
+		t.Error("bucket deleted again after the scan should not be purged")
+	}
+	if d, _, err := f.Read(i); err != nil || d != nil {
+		t.Errorf("bucket should stay in trash: %q, %v", d, err)
+	}
+	if err := f.Restore(i); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	name := testPath + "testStream.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 4096, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	index, err := f.WriteFrom(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := f.OpenReader(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, data) {
+		t.Fatal("streamed data is not matched")
+	}
+
+	if _, err := r.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = ioutil.ReadAll(r); err != nil || !bytes.Equal(d, data[len(data)-100:]) {
+		t.Errorf("data after seek is not matched: %v", err)
+	}
+
+	// 数据不足时写入失败，取出的桶放回空桶链表
+	empty := f.FileHeader().NumberOfEmptyBuckets
+	if _, err := f.WriteFrom(bytes.NewReader(data[:10]), 20); err == nil {
+		t.Error("WriteFrom should fail on short data")
+	}
+	if n := f.FileHeader().NumberOfEmptyBuckets; n != empty {
+		t.Errorf("%d empty buckets after failed write, want %d", n, empty)
+	}
+
+	// 顺序读到结尾时校验数据
+	fh := f.FileHeader()
+	f.writer.WriteAt([]byte{0xff}, fh.indexToPointer(index)+int64(fh.BucketSize)-1)
+	r, _, _ = f.OpenReader(index)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("corruption should be detected while streaming")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	name := testPath + "testWalk.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0)))
+	}
+	f.Delete(1)
+	big := make([]byte, 1000)
+	chained, _ := f.WriteChained(big)
+
+	count := 0
+	err = f.Walk(func(index int64, b Bucket) error {
+		count++
+		if index == 1 && b.Status != BUCKET_STATUS_DELETED {
+			t.Errorf("bucket 1 status %c, want 'd'", b.Status)
+		}
+		return nil
+	})
+	if err != nil || count != 16 {
+		t.Errorf("Walk visited %d buckets, %v", count, err)
+	}
+
+	it := f.Iterate(Filter{Status: []int8{BUCKET_STATUS_USED}})
+	var indexes []int64
+	for it.Next() {
+		indexes = append(indexes, it.Index())
+		if it.Index() == chained && it.Length() != int64(len(big)) {
+			t.Errorf("chained object length %d, want %d", it.Length(), len(big))
+		}
+	}
+	if it.Err() != nil || fmt.Sprint(indexes) != fmt.Sprint([]int64{0, 2, 3, chained}) {
+		t.Errorf("used buckets %v, %v", indexes, it.Err())
+	}
+
+	it = f.Iterate(Filter{From: time.Now().Unix() + 10})
+	if it.Next() {
+		t.Error("no bucket should be newer than now")
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	name := testPath + "testFsck.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0)))
+	}
+	// 0号桶在空桶链表头时回收其他桶
+	f.Empty(0)
+	f.Empty(2)
+	f.WriteChained(make([]byte, 2000))
+	f.Close()
+
+	report, err := Check(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("healthy file reported problems: %v", report.Problems)
+	}
+
+	// 模拟写文件头之后、写桶之前崩溃：空桶计数少了一个，空桶链表头指向一个已用的桶
+	f, _ = OpenFile(name, OF_RDWR)
+	f.fh.NumberOfEmptyBuckets--
+	f.fh.IndexOfEmptyBucket = 1
+	f.flushHead()
+	// 数据长度错误的桶
+	b, _ := f.readBucket(f.fh.indexToPointer(3))
+	b.DataLength = 10000
+	f.writeBucket(f.fh.indexToPointer(3), b)
+	f.Close()
+
+	report, err = Check(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("broken file reported no problem")
+	}
+
+	if report, err = Repair(name); err != nil || !report.Repaired {
+		t.Fatalf("Repair() = %v, %v", report, err)
+	}
+	report, err = Check(name)
+	if err != nil || !report.OK() {
+		t.Fatalf("problems after repair: %v, %v", report.Problems, err)
+	}
+	if report.Error != 1 || report.Used != 2 {
+		t.Errorf("unexpected bucket counts after repair: %v", report)
+	}
+
+	f, _ = OpenFile(name, OF_RDWR)
+	defer f.Close()
+	if d, _, err := f.Read(1); err != nil || string(d) != fmt.Sprintf(mtrlFmt, 1, 0) {
+		t.Errorf("data lost after repair: %q, %v", d, err)
+	}
+	for f.FileHeader().NumberOfEmptyBuckets > 0 {
+		if _, err := f.Write([]byte(mtrl1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtend(t *testing.T) {
+	name := testPath + "testExtend.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0)))
+	}
+	f.Empty(2)
+	f.Write([]byte(mtrl1))
+	if !f.IsFull() {
+		t.Fatal("file should be full")
+	}
+	if _, err := f.Write([]byte(mtrl1)); err != ErrFull {
+		t.Errorf("writing to a full file returns %v, want ErrFull", err)
+	}
+
+	if err := f.Extend(4); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(name); fi.Size() != f.Size() {
+		t.Errorf("file size %d, want %d", fi.Size(), f.Size())
+	}
+	for i := int64(4); i < 8; i++ {
+		index, err := f.Write([]byte(mtrl1))
+		if err != nil || index != i {
+			t.Fatalf("Write() = %d, %v, want %d", index, err, i)
+		}
+	}
+	if d, _, _ := f.Read(1); string(d) != fmt.Sprintf(mtrlFmt, 1, 0) {
+		t.Error("existing data changed after Extend")
+	}
+	f.Close()
+
+	if report, err := Check(name); err != nil || !report.OK() {
+		t.Errorf("problems after Extend: %v, %v", report, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	name := testPath + "testCompact.bkt"
+	compacted := testPath + "testCompact2.bkt"
+	remapName := testPath + "testCompact.remap"
+
+	os.Remove(name)
+	os.Remove(compacted)
+	f, err := CreateFile(name, 0666, 512, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 32; i++ {
+		f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0)))
+	}
+	big := bytes.Repeat([]byte(mtrl1), 40)
+	chained, _ := f.WriteChained(big)
+	for i := int64(0); i < 32; i++ {
+		if i%4 != 0 {
+			f.Empty(i)
+		}
+	}
+	f.Delete(4)
+
+	c, err := f.CompactTo(compacted, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 复制之后的修改
+	f.Empty(8)
+	f.Empty(12)
+	f.Restore(4)
+	index, _ := f.Write([]byte(mtrl1))
+	// 复制时正在被修改而跳过的桶，同步时重新复制，不再算作跳过
+	c.Skipped = append(c.Skipped, 16)
+	f.Delete(16)
+	f.Restore(16)
+	if err := c.CatchUp(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Skipped) != 0 {
+		t.Errorf("skipped after catching up: %v", c.Skipped)
+	}
+	if err := c.Remap().Save(remapName); err != nil {
+		t.Fatal(err)
+	}
+	nf := c.File()
+	defer nf.Close()
+
+	remap, err := ReadRemap(remapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remap.Lookup(8); ok {
+		t.Error("emptied bucket should not be remapped")
+	}
+	check := func(old int64, want []byte) {
+		i, ok := remap.Lookup(old)
+		if !ok {
+			t.Errorf("bucket %d is not remapped", old)
+			return
+		}
+		if d, _, err := nf.Read(i); err != nil || !bytes.Equal(d, want) {
+			t.Errorf("bucket %d => %d is not matched: %q, %v", old, i, d, err)
+		}
+	}
+	check(0, []byte(fmt.Sprintf(mtrlFmt, 0, 0)))
+	check(4, []byte(fmt.Sprintf(mtrlFmt, 4, 0)))
+	check(16, []byte(fmt.Sprintf(mtrlFmt, 16, 0)))
+	check(chained, big)
+	check(index, []byte(mtrl1))
+
+	if nf.FileHeader().NumberOfBuckets >= f.FileHeader().NumberOfBuckets {
+		t.Errorf("compacted file has %d buckets", nf.FileHeader().NumberOfBuckets)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	name := testPath + "testGeneration.bkt"
+	compacted := testPath + "testGeneration2.bkt"
+
+	os.Remove(name)
+	os.Remove(compacted)
+	f, err := CreateFile(name, 0666, 512, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data := []byte(mtrl1)
+	index, generation, err := f.WriteObject(bytes.NewReader(data), int64(len(data)))
+	if err != nil || generation == 0 {
+		t.Fatal(generation, err)
+	}
+	if d, _, err := f.ReadObject(index, generation); err != nil || !bytes.Equal(d, data) {
+		t.Fatal(d, err)
+	}
+	if d, _, err := f.ReadObject(index, 0); err != nil || !bytes.Equal(d, data) {
+		t.Fatal("id without generation should be accepted", err)
+	}
+	if _, _, err := f.ReadObject(index, generation+1); err != ErrGeneration {
+		t.Error("wrong generation should be rejected", err)
+	}
+	if err := f.DeleteObject(index, generation+1); err != ErrGeneration {
+		t.Error("wrong generation should not be deleted", err)
+	}
+	if err := f.DeleteObject(index, generation); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.PurgeObject(index, generation+1); err != ErrGeneration {
+		t.Error("wrong generation should not be purged", err)
+	}
+	if err := f.RestoreObject(index, generation); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.PurgeObject(index, generation); err == nil {
+		t.Error("object not in trash should not be purged")
+	}
+
+	// 回收之后旧的id不能再读到数据，桶重新使用时代数增加
+	if err := f.EmptyObject(index, generation); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := f.OpenObject(index, generation); err != ErrGeneration {
+		t.Error("emptied bucket should be rejected", err)
+	}
+	reused, next := INVALID_INDEX, uint32(0)
+	for i := 0; i < 8 && reused != index; i++ {
+		if reused, next, err = f.WriteObject(bytes.NewReader(data[:i+1]), int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reused != index || next != generation+1 {
+		t.Fatalf("bucket %d generation %d reused as %d generation %d", index, generation, reused, next)
+	}
+	if _, _, err := f.ReadObject(index, generation); err != ErrGeneration {
+		t.Error("stale id should be rejected", err)
+	}
+	if err := f.EmptyObject(index, generation); err != ErrGeneration {
+		t.Error("stale id should not empty the new data", err)
+	}
+
+	if err := f.Reopen(OF_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	if g, err := f.Generation(index); err != nil || g != next {
+		t.Errorf("generation %d after reopen, want %d, %v", g, next, err)
+	}
+
+	// 压缩之后按旧的索引和代数找到新的位置
+	c, err := f.CompactTo(compacted, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf := c.File()
+	defer nf.Close()
+	remap := c.Remap()
+	if _, _, ok := remap.LookupObject(index, generation); ok {
+		t.Error("stale id should not be remapped")
+	}
+	newIndex, newGeneration, ok := remap.LookupObject(index, next)
+	if !ok {
+		t.Fatal("bucket is not remapped")
+	}
+	if d, _, err := nf.ReadObject(newIndex, newGeneration); err != nil || len(d) == 0 {
+		t.Error(d, err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	name := testPath + "testMeta.bkt"
+	compacted := testPath + "testMeta2.bkt"
+
+	os.Remove(name)
+	os.Remove(compacted)
+	f, err := CreateFile(name, 0666, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	meta := &Meta{ContentType: "image/png", FileName: "a.png", Headers: map[string]string{"Owner": "fsea"}}
+	small := []byte(mtrl1)
+	big := bytes.Repeat([]byte(mtrl1), 10)
+	index, generation, err := f.WriteWithMeta(bytes.NewReader(small), int64(len(small)), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained, _, err := f.WriteWithMeta(bytes.NewReader(big), int64(len(big)), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(f *File, index int64, want *Meta, data []byte) {
+		m, err := f.ObjectMeta(index, 0)
+		if err != nil || m.ContentType != want.ContentType || m.FileName != want.FileName || fmt.Sprint(m.Headers) != fmt.Sprint(want.Headers) {
+			t.Errorf("bucket %d meta %+v, want %+v, %v", index, m, want, err)
+		}
+		if d, _, err := f.Read(index); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("bucket %d data is not matched: %v", index, err)
+		}
+	}
+	check(f, index, meta, small)
+	check(f, chained, meta, big)
+
+	// 修改元数据不改变数据
+	err = f.UpdateMeta(index, generation, func(m *Meta) {
+		m.ContentType = "text/plain"
+		delete(m.Headers, "Owner")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := &Meta{ContentType: "text/plain", FileName: "a.png"}
+	check(f, index, updated, small)
+	err = f.UpdateMeta(index, 0, func(m *Meta) {
+		m.FileName = string(bytes.Repeat([]byte("n"), 100))
+	})
+	if err == nil {
+		t.Error("metadata larger than the reserved area should be rejected")
+	}
+	plain, _ := f.Write(small)
+	if err := f.UpdateMeta(plain, 0, func(m *Meta) { m.ContentType = "text/plain" }); err == nil {
+		t.Error("object without metadata area should be rejected")
+	}
+	check(f, plain, &Meta{}, small)
+
+	f.Delete(chained)
+	if err := f.Reopen(OF_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	check(f, index, updated, small)
+
+	// 压缩之后元数据保留
+	c, err := f.CompactTo(compacted, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf := c.File()
+	defer nf.Close()
+	remap := c.Remap()
+	i, _ := remap.Lookup(index)
+	check(nf, i, updated, small)
+	i, _ = remap.Lookup(chained)
+	nf.Restore(i)
+	check(nf, i, meta, big)
+
+	// 文件还开着，Check(name)加不上锁
+	if report, _, err := f.check(); err != nil || !report.OK() {
+		t.Error(report, err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	name := testPath + "testCompress.bkt"
+	compacted := testPath + "testCompress2.bkt"
+
+	os.Remove(name)
+	os.Remove(compacted)
+	f, err := CreateFile(name, 0666, 512, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	write := func(data []byte, meta *Meta) int64 {
+		compressed, err := Compress(CODEC_GZIP, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, _, err := f.WriteCompressed(bytes.NewReader(compressed), int64(len(compressed)), meta, CODEC_GZIP, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index
+	}
+	small := bytes.Repeat([]byte(mtrl1), 4)
+	// 压缩后仍然需要多个桶
+	big := make([]byte, 8192)
+	for i, x := 0, uint32(1); i < len(big); i++ {
+		x = x*1103515245 + 12345
+		big[i] = byte(x >> 16)
+	}
+	index := write(small, nil)
+	chained := write(big, &Meta{ContentType: "application/json"})
+	if n, _ := f.bucketAt(chained); !n.ext.hasChain {
+		t.Fatal("compressed data should be chained")
+	}
+
+	check := func(f *File, index int64, data []byte) {
+		if d, _, err := f.Read(index); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("bucket %d is not matched: %v", index, err)
+		}
+		r, _, err := f.OpenReader(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("bucket %d is not matched when streaming: %v", index, err)
+		}
+		// 向前和向后Seek
+		for _, pos := range []int64{int64(len(data)) / 2, 1, int64(len(data)) - 1} {
+			if _, err := r.Seek(pos, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if d, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(d, data[pos:]) {
+				t.Errorf("bucket %d is not matched from %d: %v", index, pos, err)
+			}
+		}
+		if size, _ := r.Seek(0, io.SeekEnd); size != int64(len(data)) {
+			t.Errorf("bucket %d size %d, want %d", index, size, len(data))
+		}
+		raw, _, codec, err := f.OpenRaw(index, 0)
+		if err != nil || codec != CODEC_GZIP {
+			t.Fatal(codec, err)
+		}
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("raw data of bucket %d is not matched: %v", index, err)
+		}
+	}
+	check(f, index, small)
+	check(f, chained, big)
+	if m, err := f.ObjectMeta(chained, 0); err != nil || m.ContentType != "application/json" {
+		t.Error(m, err)
+	}
+
+	c, err := f.CompactTo(compacted, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf := c.File()
+	defer nf.Close()
+	remap := c.Remap()
+	i, _ := remap.Lookup(index)
+	check(nf, i, small)
+	i, _ = remap.Lookup(chained)
+	check(nf, i, big)
+
+	// 文件还开着，Check(name)加不上锁
+	if report, _, err := f.check(); err != nil || !report.OK() {
+		t.Error(report, err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	name := testPath + "testEncrypt.bkt"
+	compacted := testPath + "testEncrypt2.bkt"
+	keyfile := testPath + "testEncrypt.keys"
+
+	ioutil.WriteFile(keyfile, []byte("# test keys\n1 000102030405060708090a0b0c0d0e0f\n"), 0666)
+	keys, err := ReadKeyring(keyfile)
+	if err != nil || keys.Current() != 1 {
+		t.Fatal(keys, err)
+	}
+
+	os.Remove(name)
+	os.Remove(compacted)
+	f, err := CreateFile(name, 0666, 4096, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.EnableJournal(); err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := f.Write([]byte(mtrl1))
+	f.SetKeyring(keys)
+	if err := f.SetKey(2); err != ErrNoKey {
+		t.Error("setting a missing key should fail", err)
+	}
+	if err := f.SetKey(1); err != nil {
+		t.Fatal(err)
+	}
+
+	small := []byte(mtrl1)
+	// 超过一个加密分块，并且是链式对象
+	big := make([]byte, cryptChunkSize+1000)
+	for i, x := 0, uint32(1); i < len(big); i++ {
+		x = x*1103515245 + 12345
+		big[i] = byte(x >> 16)
+	}
+	index, _ := f.Write(small)
+	chained, err := f.WriteFrom(bytes.NewReader(big), int64(len(big)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := f.bucketAt(chained); b.ext.keyID != 1 || !b.ext.hasChain {
+		t.Fatal("data should be encrypted and chained", b.ext.keyID)
+	}
+	if raw, _, _, err := f.OpenRaw(plain, 0); err != nil {
+		t.Fatal(err)
+	} else if d, _ := ioutil.ReadAll(raw); string(d) != mtrl1 {
+		t.Error("plain data is not matched")
+	}
+
+	check := func(f *File, index int64, data []byte) {
+		if d, _, err := f.Read(index); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("bucket %d is not matched: %v", index, err)
+		}
+		r, _, err := f.OpenReader(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("bucket %d is not matched when streaming: %v", index, err)
+		}
+		for _, pos := range []int64{int64(len(data)) / 2, 1, int64(len(data)) - 1} {
+			if _, err := r.Seek(pos, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if d, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(d, data[pos:]) {
+				t.Errorf("bucket %d is not matched from %d: %v", index, pos, err)
+			}
+		}
+	}
+	check(f, index, small)
+	check(f, chained, big)
+
+	// 没有密钥，或者密钥不对
+	f.SetKeyring(nil)
+	if _, _, err := f.Read(index); err != ErrNoKey {
+		t.Error("reading without the key should fail", err)
+	}
+	wrong := &Keyring{}
+	wrong.Add(1, bytes.Repeat([]byte{1}, 16))
+	f.SetKeyring(wrong)
+	if _, _, err := f.Read(chained); err == nil {
+		t.Error("reading with a wrong key should fail")
+	}
+
+	// 更换密钥之后重新打开仍然使用新密钥，旧的对象改用新密钥
+	ioutil.WriteFile(keyfile, []byte("1 000102030405060708090a0b0c0d0e0f\n2 "+strings.Repeat("ab", 32)+"\n"), 0666)
+	if keys, err = ReadKeyring(keyfile); err != nil || keys.Current() != 2 {
+		t.Fatal(keys, err)
+	}
+	f.SetKeyring(keys)
+	if err := f.SetKey(keys.Current()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(OF_RDWR); err != nil || f.KeyID() != 2 {
+		t.Fatal("key id should be saved in the file header", f.KeyID(), err)
+	}
+	if m, err := New(NewMemStorage("memory"), 4096, 4); err != nil {
+		t.Fatal(err)
+	} else if _, err := m.Rekey(0); err == nil {
+		t.Error("rekeying without the journal should fail")
+	}
+	n, err := f.RekeyAll()
+	if err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if b, _ := f.bucketAt(chained); b.ext.keyID != 2 {
+		t.Error("data should be encrypted with the new key", b.ext.keyID)
+	}
+	if b, _ := f.bucketAt(plain); b.ext.keyID != 0 {
+		t.Error("plain data should not be rekeyed in place", b.ext.keyID)
+	}
+	check(f, index, small)
+	check(f, chained, big)
+
+	// 压缩时没有加密的对象也加密
+	c, err := f.CompactTo(compacted, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf := c.File()
+	defer nf.Close()
+	remap := c.Remap()
+	for old, data := range map[int64][]byte{plain: small, index: small, chained: big} {
+		i, _ := remap.Lookup(old)
+		if b, _ := nf.bucketAt(i); b.ext.keyID != 2 {
+			t.Errorf("bucket %d should be encrypted after compaction", i)
+		}
+		check(nf, i, data)
+	}
+
+	// 检查文件不需要密钥
+	f.SetKeyring(nil)
+	if report, _, err := f.check(); err != nil || !report.OK() {
+		t.Error(report, err)
+	}
+	if report, _, err := nf.check(); err != nil || !report.OK() {
+		t.Error(report, err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	name := testPath + "testStorage.bkt"
+	os.Remove(name)
+	disk, err := OpenStorage(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte(mtrl1), 30)
+	for _, s := range []Storage{NewMemStorage("memory"), disk} {
+		f, err := New(s, 512, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		small, _ := f.Write([]byte(mtrl1))
+		chained, err := f.WriteChained(big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Extend(8); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Reopen(OF_RDWR); err != nil {
+			t.Fatal(err)
+		}
+		if f.Name() != storageName(s) {
+			t.Errorf("name %q, want %q", f.Name(), storageName(s))
+		}
+		f.Close()
+
+		if _, ok := s.(*MemStorage); !ok {
+			if s, err = OpenStorage(name, os.O_RDWR, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f, err = Open(s); err != nil {
+			t.Fatal(err)
+		}
+		if d, _, err := f.Read(small); err != nil || string(d) != mtrl1 {
+			t.Errorf("%s: bucket %d is not matched: %v", f.Name(), small, err)
+		}
+		if d, _, err := f.Read(chained); err != nil || !bytes.Equal(d, big) {
+			t.Errorf("%s: bucket %d is not matched: %v", f.Name(), chained, err)
+		}
+		if fh := f.FileHeader(); fh.NumberOfBuckets != 16 {
+			t.Errorf("%s: %d buckets, want 16", f.Name(), fh.NumberOfBuckets)
+		}
+		report, _, err := f.check()
+		if err != nil || !report.OK() {
+			t.Error(report, err)
+		}
+		f.Close()
+	}
+
+	// 缩小之后再扩大，扩大的部分是0
+	m := NewMemStorage("memory")
+	m.WriteAt([]byte(mtrl1), 0)
+	if err := m.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Truncate(8); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if n, _ := m.ReadAt(buf, 0); n != 8 || string(buf) != mtrl1[:4]+"\x00\x00\x00\x00" {
+		t.Errorf("storage after shrinking is %q", buf[:n])
+	}
+
+	if f, err := New(NewMemStorage("memory"), 512, 8); err != nil {
+		t.Fatal(err)
+	} else if err := f.EnableJournal(); err == nil {
+		t.Error("journal should not be enabled in memory")
+	}
+}
+
+// 记录同步次数的存储
+type countingStorage struct {
+	*MemStorage
+	syncs int32
+}
+
+func (s *countingStorage) Sync() error {
+	atomic.AddInt32(&s.syncs, 1)
+	return s.MemStorage.Sync()
+}
+
+func TestSync(t *testing.T) {
+	s := &countingStorage{MemStorage: NewMemStorage("memory")}
+	f, err := New(s, 512, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	syncs := func() int32 { return atomic.LoadInt32(&s.syncs) }
+
+	f.Write([]byte(mtrl1))
+	if n := syncs(); n != 0 {
+		t.Errorf("%d syncs without sync mode", n)
+	}
+
+	f.SetSync(SYNC_ALWAYS, 0)
+	for i := 0; i < 3; i++ {
+		f.Write([]byte(mtrl1))
+	}
+	if n := syncs(); n != 3 {
+		t.Errorf("%d syncs after 3 writes, want 3", n)
+	}
+
+	// 成组同步：同时写入的数据共用一次同步，同步完成之后才返回
+	const interval = 50 * time.Millisecond
+	const writers = 8
+	f.SetSync(SYNC_GROUP, interval)
+	base := syncs()
+	start := time.Now()
+	var wg sync.WaitGroup
+	acked := make(chan int32, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0))); err != nil {
+				t.Error(err)
+			}
+			acked <- syncs()
+		}(i)
+	}
+	wg.Wait()
+	close(acked)
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("group writes acknowledged after %v, before the interval", elapsed)
+	}
+	for n := range acked {
+		if n == base {
+			t.Error("write acknowledged before the sync")
+		}
+	}
+	if n := syncs() - base; n < 1 || n >= writers {
+		t.Errorf("%d syncs for %d concurrent writers", n, writers)
+	}
+}
+
+func TestStats(t *testing.T) {
+	f, err := New(NewMemStorage("stats"), 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	big := bytes.Repeat([]byte(mtrl1), 30)
+	f.Write(nil)
+	small, _ := f.Write([]byte(mtrl1))
+	f.WriteChained(big)
+	deleted, _ := f.Write([]byte(mtrl1))
+	f.Delete(deleted)
+	f.Empty(small)
+
+	s, err := f.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := f.BucketsFor(int64(len(big)))
+	if s.Buckets != 16 || s.Used != 2 || s.Deleted != 1 || s.Error != 0 || s.Chained != n-1 || s.Empty != 16-2-n {
+		t.Errorf("wrong counts: %+v", s)
+	}
+	if s.Payload != int64(len(big)+len(mtrl1)) || s.Allocated != int64(n+2)*512 {
+		t.Errorf("payload %d, allocated %d", s.Payload, s.Allocated)
+	}
+	if s.Oldest == 0 || s.Newest < s.Oldest {
+		t.Errorf("oldest %d, newest %d", s.Oldest, s.Newest)
+	}
+	if s.Histogram[0] != 1 || s.Histogram[histogramSlot(int64(len(big)))] != 1 || s.Histogram[histogramSlot(int64(len(mtrl1)))] != 1 {
+		t.Errorf("wrong histogram: %v", s.Histogram)
+	}
+
+	var total Stats
+	total.Merge(s)
+	total.Merge(s)
+	if total.Used != 4 || total.Payload != 2*s.Payload || total.Histogram[0] != 2 || total.Oldest != s.Oldest {
+		t.Errorf("wrong merged stats: %+v", total)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	f, err := New(NewMemStorage("expire"), 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Now().Unix()
+	big := bytes.Repeat([]byte(mtrl1), 30)
+	write := func(data []byte, meta *Meta) (int64, uint32) {
+		index, generation, err := f.WriteWithMeta(bytes.NewReader(data), int64(len(data)), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index, generation
+	}
+	plain, _ := write([]byte(mtrl1), nil)
+	live, _ := write([]byte(mtrl1), &Meta{Expires: now + 3600})
+	expired, generation := write([]byte(mtrl1), &Meta{Expires: now - 1})
+	chained, _ := write(big, &Meta{ContentType: "text/plain", Expires: now - 1})
+
+	for _, index := range []int64{expired, chained} {
+		if _, _, err := f.Read(index); err != ErrExpired {
+			t.Errorf("bucket %d: reading expired data should fail: %v", index, err)
+		}
+		if _, _, err := f.OpenReader(index); err != ErrExpired {
+			t.Errorf("bucket %d: opening expired data should fail: %v", index, err)
+		}
+		if _, err := f.ObjectMeta(index, 0); err != ErrExpired {
+			t.Errorf("bucket %d: metadata of expired data should not be returned: %v", index, err)
+		}
+	}
+	if d, _, err := f.Read(live); err != nil || string(d) != mtrl1 {
+		t.Error(err)
+	}
+	if m, err := f.ObjectMeta(live, 0); err != nil || m.Expires != now+3600 {
+		t.Error(m, err)
+	}
+
+	// 修改过期时间
+	if err := f.UpdateMeta(live, 0, func(m *Meta) { m.Expires = now + 7200 }); err != nil {
+		t.Error(err)
+	}
+	if m, _ := f.ObjectMeta(live, 0); m.Expires != now+7200 {
+		t.Error("expiry is not updated", m.Expires)
+	}
+	if err := f.UpdateMeta(plain, 0, func(m *Meta) { m.Expires = now + 7200 }); err == nil {
+		t.Error("expiry should not be added")
+	}
+
+	indexes, generations, err := f.Expired(now)
+	if err != nil || len(indexes) != 2 || indexes[0] != expired || indexes[1] != chained || generations[0] != generation {
+		t.Fatal(indexes, generations, err)
+	}
+	for i, index := range indexes {
+		if err := f.EmptyExpired(index, generations[i], now); err != nil {
+			t.Error(err)
+		}
+	}
+	if indexes, _, _ := f.Expired(now + 7200); len(indexes) != 1 || indexes[0] != live {
+		t.Error(indexes)
+	}
+
+	// 扫描之后过期时间被推后，不回收
+	soon, generation := write([]byte(mtrl1), &Meta{Expires: now - 1})
+	if indexes, _, _ := f.Expired(now); len(indexes) != 1 || indexes[0] != soon {
+		t.Fatal(indexes)
+	}
+	f.UpdateMeta(soon, 0, func(m *Meta) { m.Expires = now + 3600 })
+	if err := f.EmptyExpired(soon, generation, now); err == nil {
+		t.Error("object with a later expiry should not be reaped")
+	}
+	if d, _, err := f.Read(soon); err != nil || string(d) != mtrl1 {
+		t.Error("object should be kept", err)
+	}
+
+	// 没有代数的旧版本文件：扫描之后桶被回收并写入新对象，不回收
+	f.UpdateMeta(soon, 0, func(m *Meta) { m.Expires = now - 1 })
+	f.Empty(soon)
+	reused, _ := write([]byte(mtrl1), nil)
+	if reused != soon {
+		t.Fatalf("bucket %d is not reused: %d", soon, reused)
+	}
+	if err := f.EmptyExpired(reused, 0, now); err == nil {
+		t.Error("reused bucket should not be reaped")
+	}
+	if d, _, err := f.Read(reused); err != nil || string(d) != mtrl1 {
+		t.Error("new object should be kept", err)
+	}
+	report, _, err := f.check()
+	if err != nil || !report.OK() {
+		t.Error(report, err)
+	}
+}
+
+func TestPunchHole(t *testing.T) {
+	name := testPath + "testPunchHole.bkt"
+	os.Remove(name)
+	disk, err := CreateFile(name, 0666, 8192, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	mem, err := New(NewMemStorage("punch"), 8192, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+
+	big := bytes.Repeat([]byte{0xff}, 3*8000)
+	for _, f := range []*File{disk, mem} {
+		if err := f.SetPunchHoles(true); err != nil {
+			t.Skip(err)
+		}
+		small, _ := f.Write(big[:100])
+		chained, _ := f.WriteChained(big)
+		kept, _ := f.Write(big[:5000])
+		f.Delete(small)
+		f.Purge(small)
+		if err := f.Empty(chained); err != nil {
+			t.Fatal(err)
+		}
+
+		// 回收的桶中数据部分是0，桶头仍然完整
+		for _, index := range []int64{small, chained, chained + 1, chained + 2} {
+			data := make([]byte, 8192-maxBucketHeaderSize)
+			f.reader.ReadAt(data, f.fh.indexToPointer(index)+maxBucketHeaderSize)
+			if !bytes.Equal(data, make([]byte, len(data))) {
+				t.Errorf("%s: bucket %d is not punched", f.Name(), index)
+			}
+		}
+		if d, _, err := f.Read(kept); err != nil || !bytes.Equal(d, big[:5000]) {
+			t.Errorf("%s: bucket %d is not matched: %v", f.Name(), kept, err)
+		}
+		report, _, err := f.check()
+		if err != nil || !report.OK() {
+			t.Error(report, err)
+		}
+		// 回收的桶可以重新使用
+		if index, err := f.WriteChained(big); err != nil {
+			t.Error(err)
+		} else if d, _, err := f.Read(index); err != nil || !bytes.Equal(d, big) {
+			t.Errorf("%s: bucket %d is not matched: %v", f.Name(), index, err)
+		}
+	}
+	if err := disk.Preallocate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// 模拟断电：第limit次之后的写入都被丢弃
+type crashDisk struct {
+	limit int
+	count int
+}
+
+func (d *crashDisk) step() bool {
+	d.count++
+	return d.count <= d.limit
+}
+
+type crashFile struct {
+	*os.File
+	disk *crashDisk
+}
+
+func (c *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	if c.disk.step() {
+		return c.File.WriteAt(p, off)
+	}
+	return len(p), nil
+}
+
+func (c *crashFile) Truncate(size int64) error {
+	if c.disk.step() {
+		return c.File.Truncate(size)
+	}
+	return nil
+}
+
+func TestHeaderCopy(t *testing.T) {
+	s := NewMemStorage("memory")
+	f, err := New(s, 512, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0)))
+	}
+	f.Empty(1)
+	want := f.FileHeader()
+	trailer := f.fh.indexToPointer(f.fh.NumberOfBuckets)
+	f.Close()
+
+	reopen := func(flag int, recovery string) *File {
+		f, err := openStorage(s, flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(f.Recovery(), recovery) || (recovery == "" && f.Recovery() != "") {
+			t.Errorf("recovery %q, want %q", f.Recovery(), recovery)
+		}
+		if fh := f.FileHeader(); fh != want {
+			t.Errorf("header %v, want %v", fh, want)
+		}
+		return f
+	}
+	reopen(OF_RDWR, "").Close()
+
+	// 副本损坏，按文件头重写
+	s.WriteAt([]byte{0xff}, trailer+10)
+	reopen(OF_RDWR, "header copy is damaged").Close()
+	reopen(OF_RDWR, "").Close()
+
+	// 文件头损坏，用副本恢复，只读时不改文件
+	s.WriteAt([]byte{0, 0}, 0)
+	reopen(OF_RDONLY, "header is damaged, recovered from header copy").Close()
+	reopen(OF_RDWR, "header is damaged, recovered from header copy").Close()
+	reopen(OF_RDWR, "").Close()
+
+	// 两份的计数都损坏，扫描重建
+	s.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f}, 12)
+	s.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f}, trailer+12)
+	f = reopen(OF_RDWR, "header and header copy are damaged")
+	if d, _, err := f.Read(2); err != nil || string(d) != fmt.Sprintf(mtrlFmt, 2, 0) {
+		t.Errorf("bucket 2 is not matched: %v", err)
+	}
+	if report, _, err := f.check(); err != nil || !report.OK() {
+		t.Error(report, err)
+	}
+	if index, err := f.Write([]byte(mtrl1)); err != nil || index != 1 {
+		t.Errorf("Write() = %d, %v, want 1", index, err)
+	}
+	f.Close()
+
+	// 不是桶文件
+	if _, err := Open(NewMemStorage("empty")); err == nil {
+		t.Error("empty storage should not be opened")
+	}
+}
+
+func TestLock(t *testing.T) {
+	name := testPath + "testLock.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := func(flag int, exclusive bool) {
+		_, err := OpenFile(name, flag)
+		if e, ok := err.(*LockError); !ok || e.Exclusive != exclusive || e.Name != name {
+			t.Errorf("OpenFile(%d) = %v, want lock error", flag, err)
+		}
+	}
+	locked(OF_RDONLY, false)
+	locked(OF_RDWR, true)
+	if _, err := Check(name); err == nil {
+		t.Error("file opened for writing should not be checked")
+	}
+	f.Close()
+
+	// 只读可以多次打开，不能同时读写打开
+	r1, err := OpenFile(name, OF_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := OpenFile(name, OF_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked(OF_RDWR, true)
+	r1.Close()
+	r2.Close()
+
+	f, err = OpenFile(name, OF_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(OF_RDWR); err != nil {
+		t.Error(err)
+	}
+	f.Close()
+}
+
+func TestIdentity(t *testing.T) {
+	s := NewMemStorage("memory")
+	f, err := New(s, 512, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := f.Identity(); !id.IsZero() {
+		t.Errorf("new file has identity %v", id)
+	}
+	want, err := NewIdentity("fsea-1", "0", "1a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetIdentity(want); err != nil {
+		t.Fatal(err)
+	}
+	if want.UUIDString()[14] != '4' {
+		t.Errorf("UUID %s is not version 4", want.UUIDString())
+	}
+	f.Close()
+
+	f, err = openStorage(s, OF_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := f.Identity(); id != want {
+		t.Errorf("identity %v, want %v", id, want)
+	}
+	if f.Recovery() != "" {
+		t.Error(f.Recovery())
+	}
+	if err := f.SetIdentity(Identity{}); err == nil {
+		t.Error("identity of read only file should not be set")
+	}
+	f.Close()
+
+	// 超过扩展部分的大小
+	f, err = openStorage(s, OF_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := want
+	long.Owner = strings.Repeat("o", 200)
+	if err := f.SetIdentity(long); err == nil {
+		t.Error("identity larger than header extension should not be set")
+	}
+	if id := f.Identity(); id != want {
+		t.Errorf("identity %v, want %v", id, want)
+	}
+	f.Close()
+}
+
+func TestWide(t *testing.T) {
+	// 超过32位的空桶索引放在chainNext中
+	for _, next := range []int64{7, math.MaxInt32 + 1, 1 << 40} {
+		b := &bucketHeader{}
+		b.setIndexOfNextEmptyBucket(next)
+		parsed, err := readBucketHeader(bytes.NewReader(b.encode()))
+		if err != nil || parsed.indexOfNextEmptyBucket() != next {
+			t.Errorf("next empty bucket %d, want %d: %v", parsed.indexOfNextEmptyBucket(), next, err)
+		}
+		if wide := next > math.MaxInt32; parsed.ext.hasChain != wide {
+			t.Errorf("next empty bucket %d stored in chainNext: %v", next, parsed.ext.hasChain)
+		}
+	}
+
+	// 0.x版本的文件头按32位读写
+	s := NewMemStorage("memory")
+	f, err := New(s, 512, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.fh.MajorVersion, f.fh.MinorVersion = 0, lastMinorVersion0
+	if err := f.flushHead(); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte(mtrl1), 5)
+	chained, err := f.WriteChained(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Extend(math.MaxInt32); err == nil {
+		t.Error("version 0 file should not have more than MaxInt32 buckets")
+	}
+	f.Close()
+
+	var h0 fileHeader0
+	binary.Read(io.NewSectionReader(s, 0, int64(sizeOfFileHeader0)), binary.LittleEndian, &h0)
+	if h0.MajorVersion != 0 || h0.NumberOfBuckets != 16 {
+		t.Errorf("version 0 header %v", h0)
+	}
+	if f, err = Open(s); err != nil {
+		t.Fatal(err)
+	}
+	if fh := f.FileHeader(); fh.MajorVersion != 0 || fh.NumberOfBuckets != 16 || f.Recovery() != "" {
+		t.Errorf("header %v, recovery %q", fh, f.Recovery())
+	}
+	if d, _, err := f.Read(chained); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("bucket %d is not matched: %v", chained, err)
+	}
+	if b, _ := f.bucketAt(chained); b.ext.chainNext64 {
+		t.Error("version 0 chain should use 4 bytes indexes")
+	}
+	f.Close()
+
+	// 0版本的日志记录，桶索引是32位的
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, []int32{1, 2, 3, 4, 1, 3, 0})
+	tx, err := decodeTransaction(body.Bytes(), 0)
+	if err != nil || fmt.Sprint(tx.alloc, tx.done) != "[[3 4]] [3]" {
+		t.Errorf("decoded %v, %v", tx, err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	name := testPath + "testJournal.bkt"
+	big := bytes.Repeat([]byte(mtrl1), 30)
+	payloads := map[string]bool{mtrl1: true, string(big): true}
+	for i := 0; i < 3; i++ {
+		payloads[fmt.Sprintf(mtrlFmt, i, 0)] = true
+	}
+
+	ops := []struct {
+		name string
+		fn   func(f *File) error
+	}{
+		{"Write", func(f *File) error { _, err := f.Write([]byte(mtrl1)); return err }},
+		{"WriteChained", func(f *File) error { _, err := f.WriteChained(big); return err }},
+		{"EmptyChained", func(f *File) error { return f.Empty(3) }},
+		{"Empty", func(f *File) error { return f.Empty(2) }},
+		{"Delete", func(f *File) error { return f.Delete(0) }},
+		{"Extend", func(f *File) error { return f.Extend(4) }},
+	}
+
+	for _, op := range ops {
+		for limit := 0; ; limit++ {
+			// 0、2号桶是小对象，3号开始是链式对象，1号桶已经回收
+			os.Remove(name)
+			f, err := CreateFile(name, 0666, 512, 24)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.EnableJournal(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				f.Write([]byte(fmt.Sprintf(mtrlFmt, i, 0)))
+			}
+			f.WriteChained(big)
+			f.Empty(1)
+			f.Close()
+
+			f, err = OpenFile(name, OF_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.Journaled() {
+				t.Fatal("journal should be enabled when the journal file exists")
+			}
+			disk := &crashDisk{limit: limit}
+			f.writer = &crashFile{f.writer.(*os.File), disk}
+			f.journal.file = &crashFile{f.journal.file.(*os.File), disk}
+			op.fn(f)
+			// 断电，不经过Close
+			f.closer.Close()
+			f.journal.file.Close()
+			crashed := disk.count > limit
+
+			f, err = OpenFile(name, OF_RDWR)
+			if err != nil {
+				t.Fatalf("%s, crash after %d writes: %v", op.name, limit, err)
+			}
+			report, _, err := f.check()
+			if err != nil || !report.OK() {
+				t.Errorf("%s, crash after %d writes: %v %v", op.name, limit, report, err)
+				for _, p := range report.Problems {
+					t.Log(p)
+				}
+			}
+			it := f.Iterate(Filter{Status: []int8{BUCKET_STATUS_USED}})
+			for it.Next() {
+				d, _, err := f.readData(it.Index(), 0)
+				if err != nil || !payloads[string(d)] {
+					t.Errorf("%s, crash after %d writes: bucket %d is broken: %v", op.name, limit, it.Index(), err)
+				}
+			}
+			f.Close()
+
+			if !crashed {
+				break
+			}
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	name := testPath + "testConcurrent.bkt"
+
+	os.Remove(name)
+	f, err := CreateFile(name, 0666, 512, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	big := bytes.Repeat([]byte(mtrl1), 30)
+	valid := func(d []byte) bool {
+		return d == nil || bytes.Equal(d, big) || bytes.HasPrefix(d, []byte("Meterial infomation item"))
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	errs := make(chan error, 100)
+	running := func() bool {
+		select {
+		case <-stop:
+			return false
+		default:
+			return true
+		}
+	}
+
+	// 写入
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; running(); i++ {
+				if i%5 == 0 {
+					f.WriteChained(big)
+				} else {
+					f.Write([]byte(fmt.Sprintf(mtrlFmt, i, w)))
+				}
+			}
+		}(w)
+	}
+	// 回收和回收站
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; running(); i++ {
+				index := int64((i*7 + w*13) % 256)
+				switch i % 3 {
+				case 0:
+					f.Empty(index)
+				case 1:
+					f.Delete(index)
+				case 2:
+					f.Restore(index)
+				}
+			}
+		}(w)
+	}
+	// 读取
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; running(); i++ {
+				index := int64((i*11 + w) % 256)
+				if w%2 == 0 {
+					d, _, err := f.Read(index)
+					if _, ok := err.(*CorruptionError); ok || (err == nil && !valid(d)) {
+						errs <- fmt.Errorf("Read(%d) = %q, %v", index, d, err)
+						return
+					}
+				} else if r, _, err := f.OpenReader(index); err == nil {
+					ioutil.ReadAll(r)
+				}
+			}
+		}(w)
+	}
+	// 遍历和重新打开
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; running(); i++ {
+			f.Walk(func(index int64, b Bucket) error { return nil })
+			f.FileHeader()
+			if i%10 == 0 {
+				if err := f.Reopen(OF_RDWR); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	report, _, err := f.check()
+	if err != nil || !report.OK() || report.Error != 0 {
+		t.Errorf("problems after concurrent access: %v, %v", report, err)
+		for _, p := range report.Problems {
+			t.Log(p)
+		}
+	}
+}
+
+// 各种同步方式下的写入延迟。ns/write是每次写入从开始到返回的平均时间
+func BenchmarkWrite(b *testing.B) {
+	modes := []struct {
+		name string
+		mode SyncMode
+	}{
+		{"None", SYNC_NONE},
+		{"Always", SYNC_ALWAYS},
+		{"Group", SYNC_GROUP},
+	}
+	data := bytes.Repeat([]byte(mtrl1), 24)
+
+	for _, m := range modes {
+		for _, parallel := range []bool{false, true} {
+			name := m.name
+			if parallel {
+				name += "Parallel"
+			}
+			b.Run(name, func(b *testing.B) {
+				name := testPath + "benchmarkWrite.bkt"
+				os.Remove(name)
+				f, err := CreateFile(name, 0666, 4096, 1024)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer f.Close()
+				f.SetSync(m.mode, 0)
+
+				var total int64
+				write := func() {
+					start := time.Now()
+					index, err := f.Write(data)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					atomic.AddInt64(&total, int64(time.Since(start)))
+					f.Empty(index)
+				}
+
+				b.ResetTimer()
+				if parallel {
+					b.SetParallelism(8)
+					b.RunParallel(func(pb *testing.PB) {
+						for pb.Next() {
+							write()
+						}
+					})
+				} else {
+					for i := 0; i < b.N; i++ {
+						write()
+					}
+				}
+				b.ReportMetric(float64(total)/float64(b.N), "ns/write")
+			})
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package bktfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// 链式桶：一个对象依次存放在多个桶中。
+// 头桶状态为'u'，记录对象总长度和下一个桶的索引；
+// 后续桶状态为'c'，记录下一个桶的索引，最后一个桶的下一个索引为INVALID_INDEX。
+// 每个桶的DataLength和校验和只针对本桶中的那一段数据。
+
+// 链式对象头桶可以存放的数据长度
+func (h *FileHeader) chainHeadCapacity() int {
+	return int(h.BucketSize) - h.bucketHeaderSize() - sizeOfExtChainLength - h.sizeOfChainNext()
+}
+
+// 链式对象后续桶可以存放的数据长度
+func (h *FileHeader) chainCapacity() int {
+	return int(h.BucketSize) - h.bucketHeaderSize() - h.sizeOfChainNext()
+}
+
+// 存放length长度的数据需要的桶个数，无法存放时返回INVALID_INDEX
+func (h *FileHeader) bucketsForLength(length int64) int64 {
+	if length <= int64(h.BucketSize)-int64(h.bucketHeaderSize()) {
+		return 1
+	}
+	headCapacity, capacity := int64(h.chainHeadCapacity()), int64(h.chainCapacity())
+	if !h.hasChain() || headCapacity <= 0 || capacity <= 0 {
+		return INVALID_INDEX
+	}
+	n := 1 + (length-headCapacity+capacity-1)/capacity
+	if n > int64(h.NumberOfBuckets) {
+		return INVALID_INDEX
+	}
+	return int64(n)
+}
+
+// 和Write一样写入数据，但数据超过一个桶时，从空桶链表中取多个桶链起来存放。
+// 返回的是头桶的索引。
+func (f *File) WriteChained(data []byte) (int64, error) {
+	index, _, err := f.write(bytes.NewReader(data), int64(len(data)), true, 0, headExt{})
+	return index, err
+}
+
+// 读取以head为头桶的链式对象，sr已经读过了头桶的桶头。调用者已经加读锁
+func (f *File) readChain(index int64, head *bucketHeader, sr io.Reader) ([]byte, int64, error) {
+	length := head.ext.chainLength
+	if length < int64(head.DataLength) || f.fh.bucketsForLength(length) <= 0 {
+		return nil, 0, errors.New("Invalid chain length.")
+	}
+
+	data := make([]byte, length)
+	piece := data[:head.DataLength]
+	if _, err := io.ReadFull(sr, piece); err != nil {
+		return nil, 0, err
+	}
+	if err := f.verify(index, head, piece); err != nil {
+		return nil, 0, err
+	}
+
+	offset := int64(len(piece))
+	next := head.ext.chainNext
+	for offset < length {
+		if next < 0 || next >= f.fh.NumberOfBuckets {
+			return nil, 0, errors.New("Broken bucket chain.")
+		}
+		sr := bufio.NewReader(io.NewSectionReader(f.reader, f.fh.indexToPointer(next), int64(f.fh.BucketSize)))
+		bucket, err := readBucketHeader(sr)
+		if err != nil {
+			return nil, 0, err
+		}
+		if bucket.isError() {
+			return nil, 0, &CorruptionError{Name: f.name, Index: next, Marked: true}
+		}
+		if !bucket.isChained() || bucket.DataLength <= 0 || int64(bucket.DataLength) > length-offset ||
+			bucket.DataLength > f.fh.BucketSize-int32(bucket.dataOffset()) {
+			return nil, 0, errors.New("Broken bucket chain.")
+		}
+		piece := data[offset : offset+int64(bucket.DataLength)]
+		if _, err := io.ReadFull(sr, piece); err != nil {
+			return nil, 0, err
+		}
+		if err := f.verify(next, bucket, piece); err != nil {
+			return nil, 0, err
+		}
+		offset += int64(len(piece))
+		next = bucket.ext.chainNext
+	}
+	data, err := f.decode(head, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, head.TimeStamp, nil
+}
+
+// 回收链式对象的所有桶，调用者已经加锁
+func (f *File) emptyChain(index int64, head *bucketHeader) error {
+	if head.ext.chainLength == 0 {
+		return errors.New("Not the head bucket of a chain.")
+	}
+
+	now := time.Now().Unix()
+	bucket := head
+	for count := int64(0); ; count++ {
+		if count >= f.fh.NumberOfBuckets {
+			return errors.New("Broken bucket chain.")
+		}
+		next := bucket.ext.chainNext
+
+		bucket.TimeStamp = now
+		if err := f.pushEmptyBucket(index, bucket); err != nil {
+			return err
+		}
+
+		if next < 0 || next >= f.fh.NumberOfBuckets {
+			break
+		}
+		b, err := f.readMeta(f.fh.indexToPointer(next))
+		if err != nil {
+			return err
+		}
+		if !(b.isChained() || (b.isError() && b.ext.hasChain)) {
+			break
+		}
+		index, bucket = next, b
+	}
+
+	return f.flushHead()
+}
+
+// 存放length长度的数据需要的桶个数，无法存放时返回INVALID_INDEX
+func (f *File) BucketsFor(length int64) int64 {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	return f.fh.bucketsForLength(length)
+}
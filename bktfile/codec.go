@@ -0,0 +1,216 @@
+package bktfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// 压缩：桶中存放的是压缩后的数据，头桶记录压缩方式和压缩前的长度。
+// 数据长度、链式对象的总长度和校验和都针对压缩后的数据。
+// 读取时透明解压，也可以用OpenRaw取得压缩后的数据。
+
+// 数据的压缩方式
+type Codec uint8
+
+const (
+	CODEC_NONE Codec = 0
+	CODEC_GZIP Codec = 1
+)
+
+const bucketExtCodec uint8 = 7
+
+// 压缩方式(1字节) + 压缩前的长度(8字节)
+const sizeOfExtCodec = 2 + 1 + 8
+
+// 写入时只在头桶中的扩展项：元数据区，数据的压缩方式，加密用的密钥，以及过期时间
+type headExt struct {
+	meta     []byte
+	metaSize int
+	codec    Codec
+	length   int64 // 压缩前的长度
+	keyID    uint32
+	nonce    []byte
+	expires  int64
+}
+
+// 头桶中这些扩展项占用的大小
+func (h *headExt) size() int {
+	size := h.metaSize
+	if h.codec != CODEC_NONE {
+		size += sizeOfExtCodec
+	}
+	if h.keyID != 0 {
+		size += sizeOfExtCipher
+	}
+	if h.expires != 0 {
+		size += sizeOfExtExpires
+	}
+	return size
+}
+
+// 对象头桶中只在头桶中的扩展项，复制对象时使用
+func (b *bucketHeader) headExt() headExt {
+	return headExt{b.ext.meta, b.ext.metaSize, b.ext.codec, b.ext.length, b.ext.keyID, b.ext.nonce, b.ext.expires}
+}
+
+func parseCodec(bucket *bucketHeader, value []byte) {
+	if len(value) == 9 {
+		bucket.ext.codec = Codec(value[0])
+		bucket.ext.length = int64(binary.LittleEndian.Uint64(value[1:]))
+	}
+}
+
+func (b *bucketHeader) encodeCodec(ext []byte) []byte {
+	if b.ext.codec == CODEC_NONE {
+		return ext
+	}
+	ext = append(ext, bucketExtCodec, 9, uint8(b.ext.codec), 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(ext[len(ext)-8:], uint64(b.ext.length))
+	return ext
+}
+
+// 按压缩方式压缩数据
+func Compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return data, nil
+	case CODEC_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("Unknown codec.")
+}
+
+func newDecoder(codec Codec, r io.Reader) (io.Reader, error) {
+	switch codec {
+	case CODEC_GZIP:
+		return gzip.NewReader(r)
+	}
+	return nil, errors.New("Unknown codec.")
+}
+
+// 解压头桶为bucket的对象的数据
+func (b *bucketHeader) decode(data []byte) ([]byte, error) {
+	if b.ext.codec == CODEC_NONE {
+		return data, nil
+	}
+	r, err := newDecoder(b.ext.codec, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	decoded := make([]byte, b.ext.length)
+	if _, err := io.ReadFull(r, decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// 解压数据的io.ReadSeeker。向前Seek时从头重新解压
+type decodeReader struct {
+	raw   io.ReadSeeker
+	codec Codec
+	size  int64 // 解压后的长度
+	pos   int64
+
+	// 当前的解压器，以及已经解压到的位置
+	zr   io.Reader
+	zpos int64
+}
+
+func (d *decodeReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	if d.zr == nil || d.zpos > d.pos {
+		if _, err := d.raw.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		zr, err := newDecoder(d.codec, d.raw)
+		if err != nil {
+			return 0, err
+		}
+		d.zr, d.zpos = zr, 0
+	}
+	if d.zpos < d.pos {
+		n, err := io.CopyN(ioutil.Discard, d.zr, d.pos-d.zpos)
+		d.zpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if rest := d.size - d.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := d.zr.Read(p)
+	d.pos += int64(n)
+	d.zpos += int64(n)
+	if err == io.EOF {
+		if d.pos < d.size {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (d *decodeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// 打开对象压缩后的数据，同时返回写入时间和压缩方式。generation不为0时先检查桶的代数。加密的数据读取时解密
+func (f *File) OpenRaw(index int64, generation uint32) (io.ReadSeeker, int64, Codec, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	r, timeStamp, head, err := f.openObject(index, generation)
+	if err != nil || head == nil {
+		return r, timeStamp, CODEC_NONE, err
+	}
+	if r, err = f.opened(r, head); err != nil {
+		return nil, 0, CODEC_NONE, err
+	}
+	return r, timeStamp, head.ext.codec, nil
+}
+
+// 写入已经按codec压缩过的数据，length是压缩前的长度，返回头桶的索引和代数
+func (f *File) WriteCompressed(r io.Reader, n int64, meta *Meta, codec Codec, length int64) (int64, uint32, error) {
+	f.locker.RLock()
+	head, err := f.fh.newHeadExt(meta)
+	if err == nil && codec != CODEC_NONE && !f.fh.hasChecksum() {
+		err = errors.New("Compression is not supported by this file version.")
+	}
+	f.locker.RUnlock()
+	if err != nil {
+		return -1, 0, err
+	}
+	if codec != CODEC_NONE {
+		head.codec, head.length = codec, length
+	}
+	return f.write(r, n, true, 0, head)
+}
@@ -0,0 +1,387 @@
+package bktfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"sort"
+)
+
+// 压缩前后桶索引和代数的对应关系，按旧索引排序
+type Remap struct {
+	Old           []int64
+	New           []int64
+	OldGeneration []uint32
+	NewGeneration []uint32
+}
+
+func newRemap(n int) *Remap {
+	return &Remap{make([]int64, n), make([]int64, n), make([]uint32, n), make([]uint32, n)}
+}
+
+type remapHeader struct {
+	Magic   uint16 // "BR"
+	Version uint8
+	_       uint8
+	Count   int32
+}
+
+const REMAP_MAGIC uint16 = 0x5242
+
+// 版本0只记录索引，版本1同时记录代数，版本2的索引是64位的
+const remapVersion uint8 = 2
+
+func (r *Remap) Len() int { return len(r.Old) }
+func (r *Remap) Swap(i, j int) {
+	r.Old[i], r.Old[j] = r.Old[j], r.Old[i]
+	r.New[i], r.New[j] = r.New[j], r.New[i]
+	r.OldGeneration[i], r.OldGeneration[j] = r.OldGeneration[j], r.OldGeneration[i]
+	r.NewGeneration[i], r.NewGeneration[j] = r.NewGeneration[j], r.NewGeneration[i]
+}
+func (r *Remap) Less(i, j int) bool { return r.Old[i] < r.Old[j] }
+
+// 查找旧索引对应的新索引
+func (r *Remap) Lookup(index int64) (int64, bool) {
+	index, _, ok := r.LookupObject(index, 0)
+	return index, ok
+}
+
+// 查找旧索引和代数对应的新索引和代数，generation为0时不检查代数
+func (r *Remap) LookupObject(index int64, generation uint32) (int64, uint32, bool) {
+	i := sort.Search(len(r.Old), func(i int) bool { return r.Old[i] >= index })
+	if i < len(r.Old) && r.Old[i] == index && (generation == 0 || r.OldGeneration[i] == generation) {
+		return r.New[i], r.NewGeneration[i], true
+	}
+	return INVALID_INDEX, 0, false
+}
+
+// 写入对应表文件。先写临时文件再改名，不会留下写了一半的文件
+func (r *Remap) Save(name string) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if len(r.Old) > math.MaxInt32 {
+		err = errors.New("Too many entries.")
+	} else {
+		err = binary.Write(w, binary.LittleEndian, remapHeader{Magic: REMAP_MAGIC, Version: remapVersion, Count: int32(len(r.Old))})
+	}
+	for i := 0; err == nil && i < len(r.Old); i++ {
+		err = binary.Write(w, binary.LittleEndian, [2]int64{r.Old[i], r.New[i]})
+		if err == nil {
+			err = binary.Write(w, binary.LittleEndian, [2]uint32{r.OldGeneration[i], r.NewGeneration[i]})
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// 读取对应表文件
+func ReadRemap(name string) (*Remap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var h remapHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if h.Magic != REMAP_MAGIC || h.Version > remapVersion || h.Count < 0 {
+		return nil, errors.New("Not a valid remap file")
+	}
+
+	remap := newRemap(int(h.Count))
+	for i := range remap.Old {
+		if h.Version < 2 {
+			var pair [2]int32
+			if err := binary.Read(r, binary.LittleEndian, &pair); err != nil {
+				return nil, err
+			}
+			remap.Old[i], remap.New[i] = int64(pair[0]), int64(pair[1])
+		} else {
+			var pair [2]int64
+			if err := binary.Read(r, binary.LittleEndian, &pair); err != nil {
+				return nil, err
+			}
+			remap.Old[i], remap.New[i] = pair[0], pair[1]
+		}
+		if h.Version < 1 {
+			continue
+		}
+		var generations [2]uint32
+		if err := binary.Read(r, binary.LittleEndian, &generations); err != nil {
+			return nil, err
+		}
+		remap.OldGeneration[i], remap.NewGeneration[i] = generations[0], generations[1]
+	}
+	if !sort.IsSorted(remap) {
+		sort.Sort(remap)
+	}
+	return remap, nil
+}
+
+// 一次压缩：把源文件中使用中和回收站中的对象复制到一个新文件
+type Compaction struct {
+	src     *File
+	dst     *File
+	entries []compactEntry
+
+	// 复制时发现数据损坏而跳过的桶
+	Skipped []int64
+}
+
+type compactEntry struct {
+	old, new                     int64
+	oldGeneration, newGeneration uint32
+}
+
+type byOld []compactEntry
+
+func (e byOld) Len() int           { return len(e) }
+func (e byOld) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byOld) Less(i, j int) bool { return e[i].old < e[j].old }
+
+// 把文件中使用中和回收站中的对象复制到一个新的桶文件name中，桶大小不变，桶个数正好放下所有对象。
+// 对象的写入时间和回收站状态保持不变，错误状态和校验失败的对象不复制。
+// 新文件使用源文件的密钥，加密的对象原样复制，没有加密的对象复制时加密。
+// 复制期间源文件仍然可以读写，被修改的桶会被记录下来；调用者停止源文件的修改之后，调用CatchUp同步这些修改。
+func (f *File) CompactTo(name string, perm os.FileMode) (*Compaction, error) {
+	f.locker.Lock()
+	f.dirty = make(map[int64]bool)
+	f.locker.Unlock()
+
+	fh := f.FileHeader()
+	keyID := f.KeyID()
+	n := int64(0)
+	err := f.scan(func(index int64, bucket *bucketHeader) error {
+		if length, ok := bucket.objectLength(); ok {
+			if count := fh.bucketsForLength(storedSize(length, bucket.headExt(), keyID)); count > 0 {
+				n += count
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		f.stopTracking()
+		return nil, err
+	}
+
+	dst, err := CreateFile(name, perm, fh.BucketSize, n)
+	if err != nil {
+		f.stopTracking()
+		return nil, err
+	}
+
+	// 新文件使用相同的密钥，没有加密的对象复制时加密
+	f.locker.RLock()
+	dst.keys = f.keys
+	f.locker.RUnlock()
+	if keyID != 0 {
+		if err := dst.SetKey(keyID); err != nil {
+			f.stopTracking()
+			dst.Close()
+			os.Remove(name)
+			return nil, err
+		}
+	}
+
+	c := &Compaction{src: f, dst: dst}
+	err = f.scan(func(index int64, bucket *bucketHeader) error {
+		return c.copy(index)
+	})
+	if err != nil {
+		f.stopTracking()
+		dst.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return c, nil
+}
+
+// 停止记录被修改的桶，返回记录下来的桶
+func (f *File) stopTracking() map[int64]bool {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	dirty := f.dirty
+	f.dirty = nil
+	return dirty
+}
+
+// 记录被修改的桶，调用者已经加锁
+func (f *File) touch(index int64) {
+	if f.dirty != nil {
+		f.dirty[index] = true
+	}
+}
+
+// 打开使用中或者回收站中的对象用来复制。不是对象的头桶时返回nil的桶头，对象无法读取时返回nil的Reader
+func (f *File) openCopy(index int64) (*bucketHeader, *bucketReader, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if f.reader == nil {
+		return nil, nil, errors.New("File is not readable")
+	}
+	bucket, err := f.readBucket(f.fh.indexToPointer(index))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := bucket.objectLength(); !ok {
+		return nil, nil, nil
+	}
+	r, err := f.openReader(index, bucket)
+	if err != nil {
+		return bucket, nil, nil
+	}
+	return bucket, r, nil
+}
+
+// 使用中或者回收站中对象的头桶，返回对象长度
+func (b *bucketHeader) objectLength() (int64, bool) {
+	if !b.isUsed() && !b.isDeleted() {
+		return 0, false
+	}
+	if b.ext.hasChain {
+		return b.ext.chainLength, b.ext.chainLength > 0
+	}
+	return int64(b.DataLength), true
+}
+
+// 复制一个对象，不是对象的头桶时什么也不做
+func (c *Compaction) copy(index int64) error {
+	bucket, r, err := c.src.openCopy(index)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return nil
+	}
+	if r == nil {
+		c.Skipped = append(c.Skipped, index)
+		return nil
+	}
+	length, _ := bucket.objectLength()
+
+	head := bucket.headExt()
+	n := c.dst.fh.bucketsForLength(storedSize(length, head, c.dst.ext.keyID))
+	if n <= 0 {
+		return errors.New("Data is too long.")
+	}
+	if n > c.dst.fh.NumberOfEmptyBuckets {
+		// 统计之后源文件又写入了数据
+		if err := c.dst.Extend(n - c.dst.fh.NumberOfEmptyBuckets); err != nil {
+			return err
+		}
+	}
+
+	newIndex, newGeneration, err := c.dst.write(r, length, true, bucket.TimeStamp, head)
+	if err != nil {
+		if _, ok := err.(*CorruptionError); ok {
+			c.Skipped = append(c.Skipped, index)
+			return nil
+		}
+		return err
+	}
+	if bucket.isDeleted() {
+		if err := c.dst.setDeleted(newIndex, true, bucket.TimeStamp, 0); err != nil {
+			return err
+		}
+	}
+	c.entries = append(c.entries, compactEntry{index, newIndex, bucket.ext.generation, newGeneration})
+	return nil
+}
+
+// 把CompactTo开始之后源文件被修改的桶同步到新文件：已经复制的先从新文件中回收，仍然是对象的重新复制。
+// 调用期间源文件不能有修改。
+func (c *Compaction) CatchUp() error {
+	dirty := c.src.stopTracking()
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	entries := c.entries[:0]
+	for _, e := range c.entries {
+		if !dirty[e.old] {
+			entries = append(entries, e)
+		} else if err := c.dst.Empty(e.new); err != nil {
+			return err
+		}
+	}
+	c.entries = entries
+
+	// 复制时损坏的桶可能只是正在被修改，重新复制之后仍然损坏的才算跳过
+	skipped := c.Skipped[:0]
+	for _, index := range c.Skipped {
+		if !dirty[index] {
+			skipped = append(skipped, index)
+		}
+	}
+	c.Skipped = skipped
+
+	for index := range dirty {
+		if err := c.copy(index); err != nil {
+			return err
+		}
+	}
+	sort.Sort(byOld(c.entries))
+	return nil
+}
+
+// 压缩得到的新文件
+func (c *Compaction) File() *File {
+	return c.dst
+}
+
+// 压缩前后的索引和代数对应关系
+func (c *Compaction) Remap() *Remap {
+	remap := newRemap(len(c.entries))
+	for i, e := range c.entries {
+		remap.Old[i], remap.New[i] = e.old, e.new
+		remap.OldGeneration[i], remap.NewGeneration[i] = e.oldGeneration, e.newGeneration
+	}
+	return remap
+}
+
+// 离线压缩：把桶文件src压缩到新文件dst，并把索引对应关系写入remapName
+func Compact(src string, dst string, remapName string) (*Remap, error) {
+	f, err := OpenFile(src, OF_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	c, err := f.CompactTo(dst, fi.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	c.File().Close()
+
+	remap := c.Remap()
+	if err := remap.Save(remapName); err != nil {
+		return nil, err
+	}
+	return remap, nil
+}
@@ -0,0 +1,487 @@
+package bktfile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 加密：0.5版本开始，对象可以用AES-GCM加密存放。文件头扩展部分记录文件当前的密钥id，新写入的对象用这个密钥加密；
+// 对象的头桶记录加密用的密钥id和随机的nonce，所以更换密钥之后旧的对象仍然可以读取，Rekey把它们改用新的密钥。
+// 加密在压缩之后进行。对象按cryptChunkSize分块加密，每块带16字节的认证标签，可以从任意位置开始解密。
+// 桶中存放的是加密后的数据，数据长度、校验和都针对加密后的数据，所以检查和压缩文件都不需要密钥。
+
+// 加密的分块大小
+const cryptChunkSize = 64 * 1024
+
+const (
+	sizeOfNonce  = 12
+	sizeOfGCMTag = 16
+)
+
+const bucketExtCipher uint8 = 8
+
+// 密钥id(4字节) + nonce(12字节)
+const sizeOfExtCipher = 2 + 4 + sizeOfNonce
+
+// 没有解密需要的密钥
+var ErrNoKey = errors.New("Key is not available.")
+
+// 按id查找的一组密钥
+type Keyring struct {
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+// 读取密钥文件。每行一个密钥：密钥id(大于0的整数) 十六进制的AES密钥(16，24或者32字节)，#开头的行是注释。
+// id最大的密钥是当前密钥，新写入的数据用它加密。更换密钥时在文件中增加一个id更大的密钥，旧的密钥保留到Rekey完成。
+func ReadKeyring(name string) (*Keyring, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid key", name, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid key id", name, line)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err.Error())
+		}
+		if err := k.Add(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == 0 {
+		return nil, fmt.Errorf("%s: no keys", name)
+	}
+	return k, nil
+}
+
+// 增加一个密钥，id最大的密钥是当前密钥
+func (k *Keyring) Add(id uint32, key []byte) error {
+	if k.keys == nil {
+		k.keys = make(map[uint32]cipher.AEAD)
+	}
+	if id == 0 {
+		return errors.New("Invalid key id.")
+	}
+	if _, ok := k.keys[id]; ok {
+		return errors.New("Duplicate key id.")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	if id > k.current {
+		k.current = id
+	}
+	return nil
+}
+
+// 当前密钥的id
+func (k *Keyring) Current() uint32 {
+	return k.current
+}
+
+func (k *Keyring) aead(id uint32) (cipher.AEAD, error) {
+	if k != nil {
+		if aead, ok := k.keys[id]; ok {
+			return aead, nil
+		}
+	}
+	return nil, ErrNoKey
+}
+
+// 加密后的长度：每块多出一个认证标签
+func sealedLength(length int64) int64 {
+	return length + (length+cryptChunkSize-1)/cryptChunkSize*sizeOfGCMTag
+}
+
+// 加密前的长度
+func openedLength(sealed int64) int64 {
+	return sealed - (sealed+cryptChunkSize+sizeOfGCMTag-1)/(cryptChunkSize+sizeOfGCMTag)*sizeOfGCMTag
+}
+
+// 第n块的nonce：对象的nonce后8字节和块序号异或。附加数据是块序号和是否最后一块，防止块被调换或者截断
+func chunkNonce(nonce []byte, n int64, last bool) ([]byte, []byte) {
+	chunk := append([]byte(nil), nonce...)
+	counter := binary.BigEndian.Uint64(chunk[4:]) ^ uint64(n)
+	binary.BigEndian.PutUint64(chunk[4:], counter)
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(n))
+	if last {
+		ad[8] = 1
+	}
+	return chunk, ad
+}
+
+// 边读边加密length长度数据的io.Reader
+type sealReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	nonce  []byte
+	length int64 // 加密前的长度
+	n      int64 // 下一块的序号
+	buf    []byte
+	out    []byte // 已经加密还没有读走的数据
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	if len(s.out) == 0 {
+		start := s.n * cryptChunkSize
+		if start >= s.length {
+			return 0, io.EOF
+		}
+		size := int64(cryptChunkSize)
+		if rest := s.length - start; rest < size {
+			size = rest
+		}
+		if _, err := io.ReadFull(s.r, s.buf[:size]); err != nil {
+			return 0, err
+		}
+		nonce, ad := chunkNonce(s.nonce, s.n, start+size == s.length)
+		s.out = s.aead.Seal(s.buf[size:size], nonce, s.buf[:size], ad)
+		s.n++
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// 用密钥keyID写入时对象存放的长度，包括头桶的扩展项。已经加密的对象原样存放
+func storedSize(length int64, head headExt, keyID uint32) int64 {
+	if keyID != 0 && head.keyID == 0 {
+		return sealedLength(length) + int64(head.size()) + sizeOfExtCipher
+	}
+	return length + int64(head.size())
+}
+
+// 解密整个对象
+func openAll(aead cipher.AEAD, nonce []byte, sealed []byte) ([]byte, error) {
+	length := openedLength(int64(len(sealed)))
+	data := make([]byte, 0, length)
+	for n := int64(0); len(sealed) > 0; n++ {
+		size := cryptChunkSize + sizeOfGCMTag
+		if len(sealed) < size {
+			size = len(sealed)
+		}
+		chunk, ad := chunkNonce(nonce, n, int64(len(data))+int64(size-sizeOfGCMTag) == length)
+		var err error
+		if data, err = aead.Open(data, chunk, sealed[:size], ad); err != nil {
+			return nil, err
+		}
+		sealed = sealed[size:]
+	}
+	return data, nil
+}
+
+// 解密数据的io.ReadSeeker，按块解密，缓存当前块
+type openReader struct {
+	raw   io.ReadSeeker
+	aead  cipher.AEAD
+	nonce []byte
+	size  int64 // 解密后的长度
+	pos   int64
+
+	n     int64 // 缓存的块的序号，-1表示没有
+	chunk []byte
+	buf   []byte
+}
+
+func newOpenReader(raw io.ReadSeeker, aead cipher.AEAD, nonce []byte, sealed int64) *openReader {
+	return &openReader{raw: raw, aead: aead, nonce: nonce, size: openedLength(sealed), n: -1}
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	n := o.pos / cryptChunkSize
+	if n != o.n {
+		start := n * cryptChunkSize
+		size := int64(cryptChunkSize)
+		if rest := o.size - start; rest < size {
+			size = rest
+		}
+		if o.buf == nil {
+			o.buf = make([]byte, cryptChunkSize+sizeOfGCMTag)
+		}
+		if _, err := o.raw.Seek(n*(cryptChunkSize+sizeOfGCMTag), io.SeekStart); err != nil {
+			return 0, err
+		}
+		sealed := o.buf[:size+sizeOfGCMTag]
+		if _, err := io.ReadFull(o.raw, sealed); err != nil {
+			return 0, err
+		}
+		nonce, ad := chunkNonce(o.nonce, n, start+size == o.size)
+		chunk, err := o.aead.Open(o.chunk[:0], nonce, sealed, ad)
+		if err != nil {
+			o.n = -1
+			return 0, err
+		}
+		o.n, o.chunk = n, chunk
+	}
+	copied := copy(p, o.chunk[o.pos-n*cryptChunkSize:])
+	o.pos += int64(copied)
+	return copied, nil
+}
+
+func (o *openReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func parseCipher(bucket *bucketHeader, value []byte) {
+	if len(value) == 4+sizeOfNonce {
+		bucket.ext.keyID = binary.LittleEndian.Uint32(value)
+		bucket.ext.nonce = append([]byte(nil), value[4:]...)
+	}
+}
+
+func (b *bucketHeader) encodeCipher(ext []byte) []byte {
+	if b.ext.keyID == 0 {
+		return ext
+	}
+	ext = append(ext, bucketExtCipher, 4+sizeOfNonce, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(ext[len(ext)-4:], b.ext.keyID)
+	return append(ext, b.ext.nonce...)
+}
+
+// 设置读写加密对象用的密钥
+func (f *File) SetKeyring(keys *Keyring) {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	f.keys = keys
+}
+
+// 文件当前的密钥id，0表示新写入的对象不加密
+func (f *File) KeyID() uint32 {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	return f.ext.keyID
+}
+
+// 设置文件当前的密钥，以后写入的对象用这个密钥加密。id为0时不再加密。
+// 只加密对象的数据，头桶中的元数据(文件名、Content-Type、X-Meta头)、长度、时间和过期时间都是明文
+func (f *File) SetKey(id uint32) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	if !f.fh.hasFileExt() || f.fh.fileExtSize() <= 0 {
+		return errors.New("Encryption is not supported by this file version.")
+	}
+	if id != 0 {
+		if _, err := f.keys.aead(id); err != nil {
+			return err
+		}
+	}
+	keyID := f.ext.keyID
+	f.ext.keyID = id
+	if err := f.flushExt(); err != nil {
+		f.ext.keyID = keyID
+		return err
+	}
+	return nil
+}
+
+// 写入之前按文件当前的密钥加密，返回加密后的数据和长度。已经加密的(复制的对象)不再加密
+func (f *File) seal(r io.Reader, length int64, head *headExt) (io.Reader, int64, error) {
+	f.locker.RLock()
+	keyID, keys := f.ext.keyID, f.keys
+	f.locker.RUnlock()
+
+	if keyID == 0 || head.keyID != 0 {
+		return r, length, nil
+	}
+	aead, err := keys.aead(keyID)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonce := make([]byte, sizeOfNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, err
+	}
+	head.keyID, head.nonce = keyID, nonce
+	buf := make([]byte, cryptChunkSize+sizeOfGCMTag)
+	return &sealReader{r: r, aead: aead, nonce: nonce, length: length, buf: buf}, sealedLength(length), nil
+}
+
+// 把桶中存放的数据还原成写入时的数据：先解密，再解压。调用者已经加读锁
+func (f *File) decode(head *bucketHeader, data []byte) ([]byte, error) {
+	if head.ext.keyID != 0 {
+		aead, err := f.keys.aead(head.ext.keyID)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = openAll(aead, head.ext.nonce, data); err != nil {
+			return nil, err
+		}
+	}
+	return head.decode(data)
+}
+
+// 按头桶解密桶中存放的数据，不解压。调用者已经加读锁
+func (f *File) opened(r io.ReadSeeker, head *bucketHeader) (io.ReadSeeker, error) {
+	if head.ext.keyID == 0 {
+		return r, nil
+	}
+	aead, err := f.keys.aead(head.ext.keyID)
+	if err != nil {
+		return nil, err
+	}
+	sealed, _ := head.objectLength()
+	return newOpenReader(r, aead, head.ext.nonce, sealed), nil
+}
+
+// 把用其他密钥加密的对象改用文件当前的密钥重新加密，数据长度不变，原地改写。返回是否改写了。
+// 一个对象的改写通过日志作为一次完整的修改提交，中途断电不会留下两个密钥都解不开的对象，所以必须使用日志。
+// 没有加密的对象长度会改变，不能原地加密，需要压缩到当前密钥的新文件中。
+func (f *File) Rekey(index int64) (bool, error) {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return false, errors.New("Index overflows.")
+	}
+	if f.writer == nil {
+		return false, errors.New("File not writealbe.")
+	}
+	if f.journal == nil {
+		return false, errors.New("Rekeying in place needs the journal.")
+	}
+	pointerToBucket := f.fh.indexToPointer(index)
+	head, err := f.readMeta(pointerToBucket)
+	if err != nil {
+		return false, err
+	}
+	if !head.isUsed() && !head.isDeleted() {
+		return false, nil
+	}
+	if head.ext.keyID == 0 || head.ext.keyID == f.ext.keyID || f.ext.keyID == 0 {
+		return false, nil
+	}
+	from, err := f.keys.aead(head.ext.keyID)
+	if err != nil {
+		return false, err
+	}
+	to, err := f.keys.aead(f.ext.keyID)
+	if err != nil {
+		return false, err
+	}
+
+	br, err := f.openReader(index, head)
+	if err != nil {
+		return false, err
+	}
+	if br.size > maxJournalRecordSize/2 {
+		return false, errors.New("Object is too large to rekey in place.")
+	}
+	sealed := make([]byte, br.size)
+	for _, s := range br.segments {
+		piece := sealed[s.start : s.start+s.length]
+		if _, err := f.reader.ReadAt(piece, s.pointer); err != nil {
+			return false, err
+		}
+		if sum := crc32.Checksum(piece, castagnoli); s.hasChecksum && sum != s.checksum {
+			return false, &CorruptionError{Name: f.name, Index: s.index, Expected: s.checksum, Actual: sum}
+		}
+	}
+	data, err := openAll(from, head.ext.nonce, sealed)
+	if err != nil {
+		return false, err
+	}
+	nonce := make([]byte, sizeOfNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return false, err
+	}
+	r := &sealReader{r: bytes.NewReader(data), aead: to, nonce: nonce, length: int64(len(data)), buf: make([]byte, cryptChunkSize+sizeOfGCMTag)}
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return false, err
+	}
+
+	// 桶头和数据一起写，日志中是一条记录
+	f.touch(index)
+	f.begin()
+	for i, s := range br.segments {
+		bucket := head
+		if i > 0 {
+			if bucket, err = f.readMeta(f.fh.indexToPointer(s.index)); err != nil {
+				return false, f.end(err)
+			}
+		} else {
+			bucket.ext.keyID, bucket.ext.nonce = f.ext.keyID, nonce
+		}
+		piece := sealed[s.start : s.start+s.length]
+		bucket.ext.checksum = crc32.Checksum(piece, castagnoli)
+		if err := f.writeMeta(f.fh.indexToPointer(s.index), append(bucket.encode(), piece...)); err != nil {
+			return false, f.end(err)
+		}
+	}
+	return true, f.end(nil)
+}
+
+// 把文件中用其他密钥加密的对象都改用当前密钥，返回改写的对象个数
+func (f *File) RekeyAll() (int, error) {
+	count := 0
+	err := f.scan(func(index int64, bucket *bucketHeader) error {
+		if bucket.ext.keyID == 0 {
+			return nil
+		}
+		done, err := f.Rekey(index)
+		if done {
+			count++
+		}
+		return err
+	})
+	return count, err
+}
@@ -0,0 +1,90 @@
+package bktfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// 过期时间：对象写入时可以带有过期时间，记录在头桶中。过期之后读取返回ErrExpired，
+// 直到被回收。过期的对象不会自动回收，由调用者用Expired找出来之后回收。
+
+// 对象已经过期
+var ErrExpired = errors.New("Object is expired.")
+
+const bucketExtExpires uint8 = 9
+
+// 过期时间(8字节)
+const sizeOfExtExpires = 2 + 8
+
+func parseExpires(bucket *bucketHeader, value []byte) {
+	if len(value) == 8 {
+		bucket.ext.expires = int64(binary.LittleEndian.Uint64(value))
+	}
+}
+
+func (b *bucketHeader) encodeExpires(ext []byte) []byte {
+	if b.ext.expires == 0 {
+		return ext
+	}
+	ext = append(ext, bucketExtExpires, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(ext[len(ext)-8:], uint64(b.ext.expires))
+	return ext
+}
+
+// 对象在now(从1970年1月1日开始的秒数)时是否已经过期
+func (b *bucketHeader) isExpired(now int64) bool {
+	return b.ext.expires != 0 && b.ext.expires <= now
+}
+
+// 检查对象是否已经过期
+func (b *bucketHeader) checkExpires() error {
+	if b.isExpired(time.Now().Unix()) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// 在now(从1970年1月1日开始的秒数)时已经过期的使用中和回收站中对象的索引和代数
+func (f *File) Expired(now int64) ([]int64, []uint32, error) {
+	var indexes []int64
+	var generations []uint32
+	err := f.scan(func(index int64, bucket *bucketHeader) error {
+		if (bucket.isUsed() || bucket.isDeleted()) && bucket.isExpired(now) {
+			indexes = append(indexes, index)
+			generations = append(generations, bucket.ext.generation)
+		}
+		return nil
+	})
+	return indexes, generations, err
+}
+
+// 回收在now时已经过期的对象，generation不为0时先检查桶的代数。
+// 在加锁之后重新检查：Expired扫描之后过期时间可能被修改，没有代数的旧版本文件中桶可能已经被回收并重新使用
+func (f *File) EmptyExpired(index int64, generation uint32, now int64) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return errors.New("Index overflows.")
+	}
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	bucket, err := f.readMeta(f.fh.indexToPointer(index))
+	if err != nil {
+		return err
+	}
+	if err := bucket.checkGeneration(generation); err != nil {
+		return err
+	}
+	if !bucket.isUsed() && !bucket.isDeleted() {
+		return errors.New("Bucket is not in use.")
+	}
+	if !bucket.isExpired(now) {
+		return errors.New("Object is not expired.")
+	}
+
+	f.begin()
+	return f.end(f.empty(index))
+}
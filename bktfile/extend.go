@@ -0,0 +1,57 @@
+package bktfile
+
+import (
+	"errors"
+)
+
+// 在文件末尾增加additionalBuckets个空桶，已有桶的索引不变。
+// 空桶链表总是以NumberOfBuckets结尾，新增的桶全部是0，下一个索引为0表示紧接着的下一个桶，
+// 所以只要先扩大文件再改文件头，新桶就接在了空桶链表的末尾。
+func (f *File) Extend(additionalBuckets int64) error {
+	if additionalBuckets <= 0 {
+		return errors.New("Invalid number of buckets.")
+	}
+
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	truncater, ok := f.writer.(interface {
+		Truncate(size int64) error
+	})
+	if !ok {
+		return errors.New("File can not be extended.")
+	}
+
+	if additionalBuckets > f.fh.maxBuckets()-f.fh.NumberOfBuckets {
+		return errors.New("Too many buckets.")
+	}
+
+	// 先截掉文件末尾可能多余的内容和文件头副本，保证新增的桶都是0，副本随文件头写到新的末尾
+	numberOfBuckets := f.fh.NumberOfBuckets + additionalBuckets
+	if err := truncater.Truncate(f.fh.indexToPointer(f.fh.NumberOfBuckets)); err != nil {
+		return err
+	}
+	if err := truncater.Truncate(f.fh.indexToPointer(numberOfBuckets) + f.fh.trailerSize()); err != nil {
+		return err
+	}
+
+	f.fh.NumberOfBuckets = numberOfBuckets
+	f.fh.NumberOfEmptyBuckets += additionalBuckets
+	if err := f.flushHead(); err != nil {
+		f.fh.NumberOfBuckets -= additionalBuckets
+		f.fh.NumberOfEmptyBuckets -= additionalBuckets
+		return err
+	}
+	return nil
+}
+
+// 文件大小
+func (f *File) Size() int64 {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	return f.fh.fileSize()
+}
@@ -0,0 +1,84 @@
+package bktfile
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 文件头扩展部分，紧跟在FileHeader之后，直到FileHeader.HeaderSize为止，
+// 和桶头扩展部分一样按 tag(1字节) + 长度(1字节) + 值 的方式存放，不认识的tag直接跳过。
+// 0.5版本开始，新文件的文件头保留到fileHeaderSize大小，扩展部分的修改不会移动桶。
+type fileExt struct {
+	keyID    uint32   // 新写入的对象加密用的密钥，0表示不加密
+	identity Identity // 文件的身份
+}
+
+const fileExtKey uint8 = 1
+
+// 0.5版本开始新文件的文件头大小
+const fileHeaderSize = 256
+
+// 0.5版本开始，文件头带有扩展部分
+func (h *FileHeader) hasFileExt() bool {
+	return h.atLeast(0, 5)
+}
+
+// 文件头扩展部分的大小
+func (h *FileHeader) fileExtSize() int {
+	return int(h.HeaderSize) - h.encodedSize()
+}
+
+// 从整个文件头部(FileHeader和扩展部分)中解析扩展部分
+func parseFileExt(h *FileHeader, data []byte) (fileExt, error) {
+	var ext fileExt
+	if !h.hasFileExt() || h.fileExtSize() <= 0 {
+		return ext, nil
+	}
+	data = data[h.encodedSize():]
+	for len(data) >= 2 {
+		tag, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			return ext, errors.New("Invalid file header extension.")
+		}
+		value := data[2 : 2+length]
+		switch tag {
+		case fileExtKey:
+			if length == 4 {
+				ext.keyID = binary.LittleEndian.Uint32(value)
+			}
+		case fileExtUUID, fileExtOwner, fileExtBucket, fileExtFile, fileExtCreated:
+			parseIdentity(&ext, tag, value)
+		}
+		data = data[2+length:]
+	}
+	return ext, nil
+}
+
+// 编码为size大小的扩展部分，剩下的空间填0
+func (e *fileExt) encode(size int) ([]byte, error) {
+	var data []byte
+	if e.keyID != 0 {
+		data = append(data, fileExtKey, 4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(data[len(data)-4:], e.keyID)
+	}
+	data, err := e.identity.encode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > size {
+		return nil, errors.New("File header extension is too large.")
+	}
+	return append(data, make([]byte, size-len(data))...), nil
+}
+
+// 写文件头扩展部分，调用者已经加锁
+func (f *File) flushExt() error {
+	if f.fh.hasHeaderCopy() {
+		return f.flushHeader()
+	}
+	data, err := f.ext.encode(f.fh.fileExtSize())
+	if err != nil {
+		return err
+	}
+	return f.writeMeta(int64(f.fh.encodedSize()), data)
+}
@@ -0,0 +1,306 @@
+package bktfile
+
+import (
+	"fmt"
+	"time"
+)
+
+// 文件检查发现的一个问题，Index为-1表示和具体的桶无关
+type Problem struct {
+	Index   int64
+	Message string
+}
+
+// 文件检查的结果
+type Report struct {
+	Name            string
+	NumberOfBuckets int64
+
+	// 各种状态的桶个数
+	Used    int64
+	Chained int64
+	Deleted int64
+	Error   int64
+	Empty   int64
+
+	// 文件头记录的空桶个数，以及从空桶链表实际数出的个数
+	HeaderEmptyBuckets int64
+	FreeListLength     int64
+
+	Problems []Problem
+	// Repair是否修改了文件
+	Repaired bool
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("%s: %d buckets, %d used, %d chained, %d deleted, %d error, %d empty, free list %d/%d, %d problems",
+		r.Name, r.NumberOfBuckets, r.Used, r.Chained, r.Deleted, r.Error, r.Empty,
+		r.FreeListLength, r.HeaderEmptyBuckets, len(r.Problems))
+	if r.Repaired {
+		s += ", repaired"
+	}
+	return s
+}
+
+func (r *Report) problem(index int64, format string, a ...interface{}) {
+	r.Problems = append(r.Problems, Problem{index, fmt.Sprintf(format, a...)})
+}
+
+// 检查得到的修复方案
+type fsckPlan struct {
+	status  []int8  // 每个桶的状态
+	link    []int64 // 空桶的下一个空桶，或者链式桶的下一个桶
+	bad     []int64 // 需要标记为错误状态的桶
+	orphan  []int64 // 需要放回空桶链表的桶
+	rebuild bool    // 需要重建空桶链表和文件头计数
+}
+
+// 只读检查一个桶文件：扫描所有的桶，检查数据长度、链式对象和空桶链表
+func Check(name string) (*Report, error) {
+	f, err := OpenFile(name, OF_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report, _, err := f.check()
+	return report, err
+}
+
+// 检查并修复一个桶文件。
+// 数据长度错误、链接断开的链式对象标记为错误状态；不属于任何对象的链式桶放回空桶链表；
+// 然后按索引顺序重建空桶链表和文件头中的计数。返回的是修复前的检查结果。
+func Repair(name string) (*Report, error) {
+	f, err := OpenFile(name, OF_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	report, plan, err := f.check()
+	if err != nil || report.OK() {
+		return report, err
+	}
+	f.begin()
+	if err = f.end(f.repair(plan)); err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+func (f *File) check() (*Report, *fsckPlan, error) {
+	n := f.fh.NumberOfBuckets
+	report := &Report{
+		Name:               f.name,
+		NumberOfBuckets:    n,
+		HeaderEmptyBuckets: f.fh.NumberOfEmptyBuckets,
+	}
+	plan := &fsckPlan{
+		status: make([]int8, n),
+		link:   make([]int64, n),
+	}
+	dataLength := make([]int32, n)
+	chainLength := make(map[int64]int64)
+
+	// 扫描所有桶头
+	for index := int64(0); index < n; index++ {
+		bucket, err := f.readBucket(f.fh.indexToPointer(index))
+		if err != nil {
+			report.problem(index, "unreadable bucket header: %s", err.Error())
+			plan.status[index] = BUCKET_STATUS_ERROR
+			plan.bad = append(plan.bad, index)
+			continue
+		}
+		plan.status[index] = bucket.Status
+		dataLength[index] = bucket.DataLength
+
+		switch bucket.Status {
+		case BUCKET_STATUS_EMPTY:
+			next := bucket.indexOfNextEmptyBucket()
+			if next == 0 {
+				next = index + 1
+			}
+			plan.link[index] = next
+			continue
+		case BUCKET_STATUS_USED, BUCKET_STATUS_DELETED, BUCKET_STATUS_CHAINED, BUCKET_STATUS_ERROR:
+		default:
+			report.problem(index, "unknown bucket status %d", bucket.Status)
+			plan.status[index] = BUCKET_STATUS_ERROR
+			plan.bad = append(plan.bad, index)
+			continue
+		}
+
+		if bucket.DataLength < 0 || bucket.DataLength > f.fh.BucketSize-int32(bucket.dataOffset()) {
+			if !bucket.isError() {
+				report.problem(index, "invalid data length %d", bucket.DataLength)
+				plan.status[index] = BUCKET_STATUS_ERROR
+				plan.bad = append(plan.bad, index)
+			}
+			continue
+		}
+
+		if bucket.ext.hasChain {
+			plan.link[index] = bucket.ext.chainNext
+			if bucket.ext.chainLength > 0 && (bucket.isUsed() || bucket.isDeleted()) {
+				chainLength[index] = bucket.ext.chainLength
+			}
+		} else if bucket.isChained() {
+			plan.link[index] = INVALID_INDEX
+		}
+	}
+
+	// 检查链式对象，记录属于某个对象的链式桶
+	claimed := make([]bool, n)
+	for index := int64(0); index < n; index++ {
+		length, ok := chainLength[index]
+		if !ok || plan.status[index] == BUCKET_STATUS_ERROR {
+			continue
+		}
+		var pieces []int64
+		total := int64(dataLength[index])
+		next := plan.link[index]
+		broken := ""
+		for total < length {
+			if next < 0 || next >= n {
+				broken = fmt.Sprintf("chain index %d out of range", next)
+				break
+			}
+			if claimed[next] {
+				broken = fmt.Sprintf("chain bucket %d is shared", next)
+				break
+			}
+			if plan.status[next] != BUCKET_STATUS_CHAINED {
+				broken = fmt.Sprintf("chain bucket %d has status %d", next, plan.status[next])
+				break
+			}
+			claimed[next] = true
+			pieces = append(pieces, next)
+			total += int64(dataLength[next])
+			next = plan.link[next]
+		}
+		if broken == "" && total != length {
+			broken = fmt.Sprintf("chain holds %d bytes, want %d", total, length)
+		}
+		if broken != "" {
+			report.problem(index, "broken chain: %s", broken)
+			plan.status[index] = BUCKET_STATUS_ERROR
+			plan.bad = append(plan.bad, index)
+			for _, piece := range pieces {
+				claimed[piece] = false
+			}
+		}
+	}
+	for index := int64(0); index < n; index++ {
+		if plan.status[index] == BUCKET_STATUS_CHAINED && !claimed[index] {
+			report.problem(index, "orphan chained bucket")
+			plan.status[index] = BUCKET_STATUS_EMPTY
+			plan.orphan = append(plan.orphan, index)
+		}
+	}
+
+	// 统计
+	for index := int64(0); index < n; index++ {
+		switch plan.status[index] {
+		case BUCKET_STATUS_USED:
+			report.Used++
+		case BUCKET_STATUS_CHAINED:
+			report.Chained++
+		case BUCKET_STATUS_DELETED:
+			report.Deleted++
+		case BUCKET_STATUS_ERROR:
+			report.Error++
+		case BUCKET_STATUS_EMPTY:
+			report.Empty++
+		}
+	}
+
+	// 沿空桶链表检查
+	seen := make([]bool, n)
+	for next := f.fh.IndexOfEmptyBucket; next != n; next = plan.link[next] {
+		if next < 0 || next > n {
+			report.problem(-1, "free list index %d out of range", next)
+			break
+		}
+		if seen[next] {
+			report.problem(next, "free list cycle")
+			break
+		}
+		if plan.status[next] != BUCKET_STATUS_EMPTY {
+			report.problem(next, "nonempty bucket on free list")
+			break
+		}
+		seen[next] = true
+		report.FreeListLength++
+	}
+	if report.FreeListLength != report.Empty {
+		report.problem(-1, "%d empty buckets, but %d on free list", report.Empty, report.FreeListLength)
+	}
+	if report.HeaderEmptyBuckets != report.Empty {
+		report.problem(-1, "%d empty buckets, but header records %d", report.Empty, report.HeaderEmptyBuckets)
+	}
+	plan.rebuild = !report.OK()
+
+	return report, plan, nil
+}
+
+// 按检查结果修复文件，调用者已经加锁
+func (f *File) repair(plan *fsckPlan) error {
+	if f.writer == nil {
+		return fmt.Errorf("%s is not writable", f.name)
+	}
+
+	now := time.Now().Unix()
+	for _, index := range plan.bad {
+		pointerToBucket := f.fh.indexToPointer(index)
+		bucket, err := f.readBucket(pointerToBucket)
+		if err != nil || bucket.isEmpty() {
+			bucket = &bucketHeader{}
+		}
+		bucket.setStatus(BUCKET_STATUS_ERROR)
+		if err := f.writeBucket(pointerToBucket, bucket); err != nil {
+			return err
+		}
+	}
+	if !plan.rebuild {
+		return nil
+	}
+
+	// 所有空桶按索引顺序链起来，最后一个指向NumberOfBuckets
+	n := f.fh.NumberOfBuckets
+	orphan := make(map[int64]bool)
+	for _, index := range plan.orphan {
+		orphan[index] = true
+	}
+	first, count := n, int64(0)
+	for index := n - 1; index >= 0; index-- {
+		if plan.status[index] != BUCKET_STATUS_EMPTY {
+			continue
+		}
+		if plan.link[index] != first || orphan[index] {
+			bucket := &bucketHeader{}
+			// 保留桶的代数，旧的id不会因为修复而重新有效
+			if old, err := f.readBucket(f.fh.indexToPointer(index)); err == nil {
+				bucket.ext.hasGeneration, bucket.ext.generation = old.ext.hasGeneration, old.ext.generation
+			}
+			bucket.setStatus(BUCKET_STATUS_EMPTY)
+			bucket.setIndexOfNextEmptyBucket(first)
+			bucket.TimeStamp = now
+			if err := f.writeBucket(f.fh.indexToPointer(index), bucket); err != nil {
+				return err
+			}
+		}
+		first = index
+		count++
+	}
+	f.fh.IndexOfEmptyBucket = first
+	f.fh.NumberOfEmptyBuckets = count
+	return f.flushHead()
+}
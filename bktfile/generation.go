@@ -0,0 +1,71 @@
+package bktfile
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// 桶的代数：0.4版本开始，桶头记录桶的代数。桶每次被取出存放新的数据时代数加1，回收时保留，
+// 所以索引和头桶的代数一起唯一确定一个对象。桶被回收或者重新使用之后，旧的代数不再匹配。
+// 代数0表示没有代数，旧版本的文件中的桶都是0，不做检查。
+
+// 索引对应的对象已经不存在
+var ErrGeneration = errors.New("Generation does not match.")
+
+func (h *FileHeader) hasGeneration() bool {
+	return h.atLeast(0, 4)
+}
+
+// 下一个代数，回绕时跳过0
+func nextGeneration(generation uint32) uint32 {
+	generation++
+	if generation == 0 {
+		generation = 1
+	}
+	return generation
+}
+
+// 检查桶是不是代数为generation的对象的头桶，generation为0时不检查
+func (b *bucketHeader) checkGeneration(generation uint32) error {
+	if generation == 0 {
+		return nil
+	}
+	if b.isEmpty() || b.isChained() || b.ext.generation != generation {
+		return ErrGeneration
+	}
+	return nil
+}
+
+// 指定桶当前的代数
+func (f *File) Generation(index int64) (uint32, error) {
+	bucket, err := f.bucketAt(index)
+	if err != nil {
+		return 0, err
+	}
+	return bucket.ext.generation, nil
+}
+
+// 和WriteFrom一样写入数据，同时返回头桶的代数
+func (f *File) WriteObject(r io.Reader, n int64) (int64, uint32, error) {
+	return f.write(r, n, true, 0, headExt{})
+}
+
+// 和Read一样读取数据，generation不为0时先检查桶的代数
+func (f *File) ReadObject(index int64, generation uint32) ([]byte, int64, error) {
+	data, timeStamp, err := f.read(index, generation)
+	if err != nil {
+		f.markError(err)
+	}
+	return data, timeStamp, err
+}
+
+// 和Delete一样把对象放入回收站，generation不为0时先检查桶的代数
+func (f *File) DeleteObject(index int64, generation uint32) error {
+	return f.setDeleted(index, true, time.Now().Unix(), generation)
+}
+
+// 和Restore一样从回收站中恢复对象，generation不为0时先检查桶的代数
+func (f *File) RestoreObject(index int64, generation uint32) error {
+	return f.setDeleted(index, false, time.Now().Unix(), generation)
+}
@@ -0,0 +1,228 @@
+package bktfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// 文件头副本：0.6版本开始，最后一个桶之后保留一份和文件头部(FileHeader和扩展部分)完全相同的副本，
+// 扩展部分的第一项是整个文件头部的校验和。修改文件头时两份一起写，使用日志时在同一次修改中提交。
+// 打开文件时两份都检查：文件头损坏时用副本恢复；副本损坏或者和文件头不同时，以先写的文件头为准重写副本；
+// 两份都损坏时，按文件大小推算桶的个数，扫描所有的桶重建空桶链表和文件头中的计数。
+
+const fileExtChecksum uint8 = 2
+
+// 校验和(4字节)
+const sizeOfFileExtChecksum = 2 + 4
+
+// 0.6版本开始，文件末尾有文件头副本
+func (h *FileHeader) hasHeaderCopy() bool {
+	return h.atLeast(0, 6)
+}
+
+// 文件末尾副本的大小
+func (h *FileHeader) trailerSize() int64 {
+	if h.hasHeaderCopy() {
+		return int64(h.HeaderSize)
+	}
+	return 0
+}
+
+// 文件大小，包括末尾的副本
+func (h *FileHeader) fileSize() int64 {
+	return h.indexToPointer(h.NumberOfBuckets) + h.trailerSize()
+}
+
+// 整个文件头部的CRC32C，校验和的值本身不计算在内
+func (h *FileHeader) checksum(data []byte) uint32 {
+	offset := h.encodedSize()
+	crc := crc32.Update(0, castagnoli, data[:offset+2])
+	return crc32.Update(crc, castagnoli, data[offset+sizeOfFileExtChecksum:])
+}
+
+// 编码整个文件头部，调用者已经加锁
+func (f *File) encodeHeader() ([]byte, error) {
+	ext, err := f.ext.encode(f.fh.fileExtSize() - sizeOfFileExtChecksum)
+	if err != nil {
+		return nil, err
+	}
+	data := append(f.fh.encode(), fileExtChecksum, 4, 0, 0, 0, 0)
+	data = append(data, ext...)
+	binary.LittleEndian.PutUint32(data[f.fh.encodedSize()+2:], f.fh.checksum(data))
+	return data, nil
+}
+
+// 写整个文件头部和末尾的副本，调用者已经加锁
+func (f *File) flushHeader() error {
+	data, err := f.encodeHeader()
+	if err != nil {
+		return err
+	}
+	if err := f.writeMeta(0, data); err != nil {
+		return err
+	}
+	return f.writeMeta(f.fh.indexToPointer(f.fh.NumberOfBuckets), data)
+}
+
+// 从存储中读到的一份文件头部
+type headerCopy struct {
+	fh   FileHeader
+	data []byte
+	ok   bool // 文件头有效，0.6版本开始还要校验和正确
+}
+
+// 读取pointer处的文件头部，size是存储的大小
+func readHeaderAt(r io.ReaderAt, pointer int64, size int64) *headerCopy {
+	h := &headerCopy{}
+	if pointer < 0 || pointer+int64(sizeOfFileHeader0) > size {
+		return h
+	}
+	var err error
+	if h.fh, err = readFileHeader(r, pointer); err != nil {
+		return h
+	}
+	if !h.fh.isValid() || int(h.fh.HeaderSize) < h.fh.encodedSize() {
+		return h
+	}
+	if !h.fh.hasHeaderCopy() {
+		// 旧版本只检查文件头，扩展部分照常读取
+		h.data = make([]byte, h.fh.HeaderSize)
+		_, err := r.ReadAt(h.data, pointer)
+		h.ok = err == nil || !h.fh.hasFileExt()
+		return h
+	}
+	if int(h.fh.HeaderSize) < h.fh.encodedSize()+sizeOfFileExtChecksum {
+		return h
+	}
+	h.data = make([]byte, h.fh.HeaderSize)
+	if _, err := r.ReadAt(h.data, pointer); err != nil {
+		return h
+	}
+	ext := h.data[h.fh.encodedSize():]
+	h.ok = ext[0] == fileExtChecksum && ext[1] == 4 &&
+		binary.LittleEndian.Uint32(ext[2:]) == h.fh.checksum(h.data)
+	return h
+}
+
+// 文件头损坏时，按其中的版本、文件头大小和桶大小，从文件大小推算桶的个数。推算不出来时返回false
+func (h *FileHeader) guessGeometry(size int64) bool {
+	if !h.knownVersion() || h.BucketSize <= 0 {
+		return false
+	}
+	// 文件头大小只能是创建文件时的大小
+	if (h.hasFileExt() && h.HeaderSize != fileHeaderSize) || (!h.hasFileExt() && int(h.HeaderSize) != h.encodedSize()) {
+		return false
+	}
+	length := size - int64(h.HeaderSize) - h.trailerSize()
+	if length <= 0 || length%int64(h.BucketSize) != 0 || length/int64(h.BucketSize) > h.maxBuckets() {
+		return false
+	}
+	h.Magic = BUCKETFILE_MAGIC
+	h.NumberOfBuckets = length / int64(h.BucketSize)
+	h.NumberOfEmptyBuckets = 0
+	h.IndexOfEmptyBucket = h.NumberOfBuckets
+	return true
+}
+
+// 打开文件时读取文件头，需要时用副本恢复或者扫描重建，恢复的情况记在f.recovery中。
+// 可写时把恢复的结果写回文件。文件还没有被别人使用，不需要加锁
+func (f *File) readHeader(size int64) error {
+	primary := readHeaderAt(f.reader, 0, size)
+	if primary.ok && !primary.fh.hasHeaderCopy() {
+		f.fh = primary.fh
+		return f.readExt(primary.data)
+	}
+
+	if primary.ok {
+		f.fh = primary.fh
+		pointer := f.fh.indexToPointer(f.fh.NumberOfBuckets)
+		trailer := readHeaderAt(f.reader, pointer, size)
+		if trailer.ok && bytes.Equal(trailer.data, primary.data) {
+			return f.readExt(primary.data)
+		}
+		if trailer.ok {
+			f.recovery = "header copy differs from header"
+		} else {
+			f.recovery = "header copy is damaged"
+		}
+		if err := f.rewriteHeader(pointer, primary.data); err != nil {
+			return err
+		}
+		return f.readExt(primary.data)
+	}
+
+	// 文件头损坏，副本在文件末尾
+	trailer := readHeaderAt(f.reader, size-fileHeaderSize, size)
+	if trailer.ok && trailer.fh.hasHeaderCopy() && trailer.fh.fileSize() == size {
+		f.fh = trailer.fh
+		f.recovery = "header is damaged, recovered from header copy"
+		if err := f.rewriteHeader(0, trailer.data); err != nil {
+			return err
+		}
+		return f.readExt(trailer.data)
+	}
+
+	// 两份都损坏，扫描所有的桶
+	fh := primary.fh
+	if !fh.guessGeometry(size) {
+		fh = trailer.fh
+		if !fh.guessGeometry(size) {
+			return errors.New("Not a valid bucket file")
+		}
+	}
+	f.fh = fh
+	return f.rebuildHeader()
+}
+
+// 用有效的一份文件头部重写另一份，调用者记下了恢复的原因
+func (f *File) rewriteHeader(pointer int64, data []byte) error {
+	if f.writer == nil {
+		f.recovery += ", not rewritten (read only)"
+		return nil
+	}
+	if err := f.writeDirect(pointer, data); err != nil {
+		return err
+	}
+	f.recovery += ", rewritten"
+	return nil
+}
+
+func (f *File) readExt(data []byte) error {
+	var err error
+	f.ext, err = parseFileExt(&f.fh, data)
+	return err
+}
+
+// 扫描所有的桶，重建空桶链表和文件头中的计数。只读时只在内存中恢复计数，文件不能写入。
+// 文件头扩展部分无法恢复，按空的处理
+func (f *File) rebuildHeader() error {
+	report, plan, err := f.check()
+	if err != nil {
+		return err
+	}
+	f.recovery = fmt.Sprintf("header and header copy are damaged, rebuilt by scanning %d buckets (%d empty)",
+		f.fh.NumberOfBuckets, report.Empty)
+	if f.writer == nil {
+		f.fh.NumberOfEmptyBuckets = report.Empty
+		f.recovery += ", not rewritten (read only)"
+		return nil
+	}
+	plan.rebuild = true
+	if err := f.repair(plan); err != nil {
+		return err
+	}
+	f.recovery += ", rewritten"
+	return nil
+}
+
+// 打开文件时文件头的恢复情况，文件头正常时为空
+func (f *File) Recovery() string {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	return f.recovery
+}
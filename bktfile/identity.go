@@ -0,0 +1,126 @@
+package bktfile
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 文件身份：记录在文件头扩展部分中，包括文件的UUID、创建文件的节点和创建时的桶目录id、文件id、创建时间。
+// 挂载时和配置比较，可以发现从别的服务器或者目录复制过来的文件；配置丢失时也可以按它找回文件id。
+type Identity struct {
+	UUID    [16]byte
+	Owner   string // 创建文件的fsea的Config.Id
+	Bucket  string // 桶目录id
+	File    string // 文件id
+	Created int64  // 创建时间，从1970年1月1日开始的秒数
+}
+
+const (
+	fileExtUUID    uint8 = 3
+	fileExtOwner   uint8 = 4
+	fileExtBucket  uint8 = 5
+	fileExtFile    uint8 = 6
+	fileExtCreated uint8 = 7
+)
+
+// 生成一个新的身份，UUID随机生成，创建时间为当前时间
+func NewIdentity(owner string, bucket string, file string) (Identity, error) {
+	id := Identity{Owner: owner, Bucket: bucket, File: file, Created: time.Now().Unix()}
+	if _, err := rand.Read(id.UUID[:]); err != nil {
+		return id, err
+	}
+	// 版本4，RFC 4122
+	id.UUID[6] = id.UUID[6]&0x0f | 0x40
+	id.UUID[8] = id.UUID[8]&0x3f | 0x80
+	return id, nil
+}
+
+// 没有记录身份
+func (id *Identity) IsZero() bool {
+	return id.UUID == [16]byte{}
+}
+
+func (id *Identity) UUIDString() string {
+	u := id.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+func (id Identity) String() string {
+	if id.IsZero() {
+		return "Identity: none\n"
+	}
+	return fmt.Sprintf("UUID: %s\nOwner: %s\nBucket: %s\nFile: %s\nCreated: %s\n", id.UUIDString(),
+		id.Owner, id.Bucket, id.File, time.Unix(id.Created, 0).Format("2006-01-02 15:04:05"))
+}
+
+func parseIdentity(ext *fileExt, tag uint8, value []byte) {
+	id := &ext.identity
+	switch tag {
+	case fileExtUUID:
+		if len(value) == 16 {
+			copy(id.UUID[:], value)
+		}
+	case fileExtOwner:
+		id.Owner = string(value)
+	case fileExtBucket:
+		id.Bucket = string(value)
+	case fileExtFile:
+		id.File = string(value)
+	case fileExtCreated:
+		if len(value) == 8 {
+			id.Created = int64(binary.LittleEndian.Uint64(value))
+		}
+	}
+}
+
+func (id *Identity) encode(data []byte) ([]byte, error) {
+	if id.IsZero() {
+		return data, nil
+	}
+	data = append(data, fileExtUUID, 16)
+	data = append(data, id.UUID[:]...)
+	for _, s := range []struct {
+		tag   uint8
+		value string
+	}{{fileExtOwner, id.Owner}, {fileExtBucket, id.Bucket}, {fileExtFile, id.File}} {
+		if len(s.value) > 255 {
+			return nil, errors.New("Identity is too long.")
+		}
+		data = append(data, s.tag, uint8(len(s.value)))
+		data = append(data, s.value...)
+	}
+	data = append(data, fileExtCreated, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(data[len(data)-8:], uint64(id.Created))
+	return data, nil
+}
+
+// 文件的身份，没有记录时IsZero()为true
+func (f *File) Identity() Identity {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	return f.ext.identity
+}
+
+// 设置文件的身份
+func (f *File) SetIdentity(id Identity) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	if !f.fh.hasFileExt() || f.fh.fileExtSize() <= 0 {
+		return errors.New("Identity is not supported by this file version.")
+	}
+	identity := f.ext.identity
+	f.ext.identity = id
+	if err := f.flushExt(); err != nil {
+		f.ext.identity = identity
+		return err
+	}
+	return nil
+}
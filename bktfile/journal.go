@@ -0,0 +1,473 @@
+package bktfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// 日志：文件头和桶头的修改先整个记到桶文件旁边的日志文件(name.journal)中，日志同步到磁盘之后再改桶文件，
+// 所以一次修改要么完整生效，要么完全没有发生。数据部分不记日志。
+// 写入数据分两步：取出空桶时记一条分配记录，同时改文件头；数据写完之后记一条完成记录，同时写桶头。
+// 打开文件时重做日志中所有完整的记录，没有完成的分配把桶放回空桶链表，然后清空日志。
+// 日志文件存在时，打开文件就自动使用日志。
+
+const JOURNAL_MAGIC uint16 = 0x524a
+
+// 日志超过这个大小时，同步桶文件后清空日志
+const journalCheckpointSize = 1 << 20
+
+// 一条记录的最大长度，超过的认为日志已经损坏
+const maxJournalRecordSize = 1 << 28
+
+type journalFile interface {
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type journal struct {
+	name string
+	file journalFile
+	size int64
+
+	// 还没有完成的分配，按头桶索引
+	pending map[int64][]int64
+}
+
+// 一条日志记录，也就是一次修改
+type transaction struct {
+	alloc  [][]int64 // 这次修改取出的桶
+	done   []int64   // 完成了的分配的头桶索引
+	writes []journalWrite
+	index  map[int64]int
+}
+
+type journalWrite struct {
+	pointer int64
+	data    []byte
+}
+
+type journalRecordHeader struct {
+	Magic   uint16
+	Version uint16
+	Length  int32 // 记录体长度，后面还有4字节的CRC32C
+}
+
+// 记录的版本，0版本的桶索引是32位的，1版本是64位的
+const journalVersion uint16 = 1
+
+func journalName(name string) string {
+	return name + ".journal"
+}
+
+func newTransaction() *transaction {
+	return &transaction{index: make(map[int64]int)}
+}
+
+// 记录一次写入，同一位置的写入只保留最后一次
+func (tx *transaction) add(pointer int64, data []byte) {
+	if i, ok := tx.index[pointer]; ok {
+		tx.writes[i].data = data
+		return
+	}
+	tx.index[pointer] = len(tx.writes)
+	tx.writes = append(tx.writes, journalWrite{pointer, data})
+}
+
+func (tx *transaction) lookup(pointer int64) ([]byte, bool) {
+	if i, ok := tx.index[pointer]; ok {
+		return tx.writes[i].data, true
+	}
+	return nil, false
+}
+
+func (tx *transaction) isEmpty() bool {
+	return len(tx.alloc) == 0 && len(tx.done) == 0 && len(tx.writes) == 0
+}
+
+func (tx *transaction) encode() []byte {
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, int32(len(tx.alloc)))
+	for _, indexes := range tx.alloc {
+		binary.Write(&body, binary.LittleEndian, int32(len(indexes)))
+		binary.Write(&body, binary.LittleEndian, indexes)
+	}
+	binary.Write(&body, binary.LittleEndian, int32(len(tx.done)))
+	binary.Write(&body, binary.LittleEndian, tx.done)
+	binary.Write(&body, binary.LittleEndian, int32(len(tx.writes)))
+	for _, w := range tx.writes {
+		binary.Write(&body, binary.LittleEndian, w.pointer)
+		binary.Write(&body, binary.LittleEndian, int32(len(w.data)))
+		body.Write(w.data)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, journalRecordHeader{Magic: JOURNAL_MAGIC, Version: journalVersion, Length: int32(body.Len())})
+	buf.Write(body.Bytes())
+	binary.Write(&buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(), castagnoli))
+	return buf.Bytes()
+}
+
+// 读取n个桶索引
+func readIndexes(r *bytes.Reader, n int32, version uint16) ([]int64, error) {
+	size := int64(8)
+	if version == 0 {
+		size = 4
+	}
+	if n < 0 || int64(n)*size > int64(r.Len()) {
+		return nil, errors.New("Invalid journal record.")
+	}
+	indexes := make([]int64, n)
+	if version > 0 {
+		err := binary.Read(r, binary.LittleEndian, indexes)
+		return indexes, err
+	}
+	narrow := make([]int32, n)
+	if err := binary.Read(r, binary.LittleEndian, narrow); err != nil {
+		return nil, err
+	}
+	for i, index := range narrow {
+		indexes[i] = int64(index)
+	}
+	return indexes, nil
+}
+
+func decodeTransaction(body []byte, version uint16) (*transaction, error) {
+	r := bytes.NewReader(body)
+	tx := newTransaction()
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := int32(0); i < n; i++ {
+		var count int32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+		if count <= 0 {
+			return nil, errors.New("Invalid journal record.")
+		}
+		indexes, err := readIndexes(r, count, version)
+		if err != nil {
+			return nil, err
+		}
+		tx.alloc = append(tx.alloc, indexes)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	var err error
+	if tx.done, err = readIndexes(r, n, version); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := int32(0); i < n; i++ {
+		var pointer int64
+		var length int32
+		if err := binary.Read(r, binary.LittleEndian, &pointer); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, err
+		}
+		if pointer < 0 || length < 0 || int64(length) > int64(r.Len()) {
+			return nil, errors.New("Invalid journal record.")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		tx.add(pointer, data)
+	}
+	return tx, nil
+}
+
+// 读出日志中所有完整的记录，写了一半的记录和之后的内容被忽略
+func readJournal(r io.Reader) []*transaction {
+	br := bufio.NewReader(r)
+	var txs []*transaction
+	headerSize := binary.Size(journalRecordHeader{})
+	for {
+		head := make([]byte, headerSize)
+		if _, err := io.ReadFull(br, head); err != nil {
+			break
+		}
+		var h journalRecordHeader
+		binary.Read(bytes.NewReader(head), binary.LittleEndian, &h)
+		if h.Magic != JOURNAL_MAGIC || h.Version > journalVersion || h.Length < 0 || h.Length > maxJournalRecordSize {
+			break
+		}
+		record := make([]byte, headerSize+int(h.Length)+4)
+		copy(record, head)
+		if _, err := io.ReadFull(br, record[headerSize:]); err != nil {
+			break
+		}
+		sum := binary.LittleEndian.Uint32(record[len(record)-4:])
+		if crc32.Checksum(record[:len(record)-4], castagnoli) != sum {
+			break
+		}
+		tx, err := decodeTransaction(record[headerSize:len(record)-4], h.Version)
+		if err != nil {
+			break
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// 重做日志记录中的写入
+func replayJournal(w io.WriterAt, txs []*transaction) error {
+	for _, tx := range txs {
+		for _, write := range tx.writes {
+			if _, err := w.WriteAt(write.data, write.pointer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 日志中没有完成的分配
+func pendingAllocs(txs []*transaction) [][]int64 {
+	pending := make(map[int64][]int64)
+	var order []int64
+	for _, tx := range txs {
+		for _, indexes := range tx.alloc {
+			pending[indexes[0]] = indexes
+			order = append(order, indexes[0])
+		}
+		for _, head := range tx.done {
+			delete(pending, head)
+		}
+	}
+	var allocs [][]int64
+	for _, head := range order {
+		if indexes, ok := pending[head]; ok {
+			allocs = append(allocs, indexes)
+			delete(pending, head)
+		}
+	}
+	return allocs
+}
+
+// 给文件启用日志，以后文件头和桶头的修改都先记日志。应该在写入数据之前调用。
+func (f *File) EnableJournal() error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+
+	if f.journal != nil {
+		return nil
+	}
+	// 日志文件放在桶文件旁边，只有操作系统中的文件可以使用日志
+	if _, ok := f.storage.(*os.File); !ok {
+		return errors.New("Journal is only supported for files on disk.")
+	}
+	if err := f.sync(); err != nil {
+		return err
+	}
+	name := journalName(f.name)
+	jf, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	f.journal = &journal{name: name, file: jf, pending: make(map[int64][]int64)}
+	return nil
+}
+
+// 文件是否使用日志
+func (f *File) Journaled() bool {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	return f.journal != nil
+}
+
+// 打开文件时按日志恢复：文件大小不够的补足，没有完成的分配放回空桶链表，最后清空日志。
+// 日志中的写入已经重做过了
+func (f *File) recover(txs []*transaction) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if truncater, ok := f.writer.(interface {
+		Truncate(size int64) error
+	}); ok {
+		size := f.fh.fileSize()
+		if current, err := storageSize(f.storage); err == nil && current < size {
+			if err := truncater.Truncate(size); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, indexes := range pendingAllocs(txs) {
+		f.journal.pending[indexes[0]] = indexes
+		f.begin()
+		var err error
+		for i := len(indexes) - 1; i >= 0 && err == nil; i-- {
+			var bucket *bucketHeader
+			if bucket, err = f.readMeta(f.fh.indexToPointer(indexes[i])); err == nil && bucket.isEmpty() {
+				bucket.TimeStamp = now
+				err = f.pushEmptyBucket(indexes[i], bucket)
+			}
+		}
+		if err == nil {
+			err = f.flushHead()
+		}
+		f.journalDone(indexes[0])
+		if err = f.end(err); err != nil {
+			return err
+		}
+	}
+	return f.checkpoint()
+}
+
+// 开始一次修改，之后的写入先记下来，end的时候一起提交。调用者已经加锁
+func (f *File) begin() {
+	if f.journal != nil && f.tx == nil {
+		f.tx = newTransaction()
+	}
+}
+
+// 提交这次修改，返回err或者提交时的错误。桶头都写完之后才给回收的桶打洞。调用者已经加锁
+func (f *File) end(err error) error {
+	if e := f.commit(); err == nil {
+		err = e
+	}
+	if err == nil {
+		f.punchFreed()
+	}
+	f.freed = nil
+	return err
+}
+
+// 记录这次修改取出的桶
+func (f *File) journalAlloc(indexes []int64) {
+	if f.tx != nil {
+		f.tx.alloc = append(f.tx.alloc, indexes)
+	}
+}
+
+// 记录头桶为head的分配已经完成
+func (f *File) journalDone(head int64) {
+	if f.tx != nil {
+		f.tx.done = append(f.tx.done, head)
+	}
+}
+
+// 先写日志并同步，再把修改写入桶文件
+func (f *File) commit() error {
+	tx := f.tx
+	f.tx = nil
+	if tx == nil || tx.isEmpty() {
+		return nil
+	}
+
+	// 完成记录写入之后桶头就生效了，在这之前数据要先到磁盘
+	if len(tx.done) > 0 {
+		if err := f.sync(); err != nil {
+			return err
+		}
+	}
+
+	j := f.journal
+	record := tx.encode()
+	if _, err := j.file.WriteAt(record, j.size); err != nil {
+		j.file.Truncate(j.size)
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(record))
+	for _, indexes := range tx.alloc {
+		j.pending[indexes[0]] = indexes
+	}
+	for _, head := range tx.done {
+		delete(j.pending, head)
+	}
+
+	for _, w := range tx.writes {
+		if err := f.writeDirect(w.pointer, w.data); err != nil {
+			return err
+		}
+	}
+	if j.size >= journalCheckpointSize {
+		return f.checkpoint()
+	}
+	return nil
+}
+
+// 同步桶文件之后，用只有未完成分配的新日志替换旧日志。调用者已经加锁
+func (f *File) checkpoint() error {
+	if err := f.sync(); err != nil {
+		return err
+	}
+
+	j := f.journal
+	tx := newTransaction()
+	for _, indexes := range j.pending {
+		tx.alloc = append(tx.alloc, indexes)
+	}
+	var record []byte
+	if !tx.isEmpty() {
+		record = tx.encode()
+	}
+
+	tmp := j.name + ".tmp"
+	jf, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = jf.Write(record)
+	if err == nil {
+		err = jf.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.name)
+	}
+	if err != nil {
+		jf.Close()
+		os.Remove(tmp)
+		return err
+	}
+	j.file.Close()
+	j.file, j.size = jf, int64(len(record))
+	return nil
+}
+
+// 把桶文件同步到磁盘
+func (f *File) sync() error {
+	if s, ok := f.writer.(interface {
+		Sync() error
+	}); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// 按日志恢复文件，没有日志时什么也不做。只读打开有未重做日志的文件会失败，所以检查文件之前先恢复
+func Recover(name string) error {
+	if _, err := os.Stat(journalName(name)); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := OpenFile(name, OF_RDWR)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
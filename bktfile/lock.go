@@ -0,0 +1,22 @@
+package bktfile
+
+import (
+	"fmt"
+)
+
+// 文件锁：OpenFile和CreateFile打开操作系统中的文件时加建议锁(flock)，读写打开加排他锁，只读打开加共享锁，
+// 文件关闭时释放。锁属于打开的文件而不是进程，同一个进程中两次打开同一个文件也会冲突。
+// 不支持flock的系统不加锁。
+
+// 文件已经被别的进程(或者同一个进程中别的地方)打开，加不上锁
+type LockError struct {
+	Name      string
+	Exclusive bool
+}
+
+func (e *LockError) Error() string {
+	if e.Exclusive {
+		return fmt.Sprintf("%s is locked by another process, can not open it for writing", e.Name)
+	}
+	return fmt.Sprintf("%s is locked for writing by another process, can not open it", e.Name)
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bktfile
+
+import (
+	"os"
+)
+
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,218 @@
+package bktfile
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+// 对象的元数据存放在头桶的桶头扩展部分的最后：一项元数据，加上填充的保留空间。
+// 元数据区的大小在写入时确定，之后修改元数据只要不超过这个大小，桶头大小不变，数据不用移动。
+// 0.2版本开始的文件支持元数据，不认识元数据的旧程序会跳过这些扩展项。
+
+// 对象的元数据
+type Meta struct {
+	ContentType string
+	FileName    string
+	Headers     map[string]string // 用户自定义的键值对
+	Expires     int64             // 过期时间，从1970年1月1日开始的秒数，0表示不过期。和元数据区分开存放
+}
+
+const (
+	bucketExtMeta    uint8 = 5
+	bucketExtPadding uint8 = 6
+)
+
+// 元数据中各项的类型
+const (
+	metaContentType uint8 = 1
+	metaFileName    uint8 = 2
+	metaHeader      uint8 = 3
+)
+
+// 元数据区按这个大小对齐，留出修改的余地
+const metaAlign = 32
+
+// 元数据区最大的大小：带有过期时间的链式的压缩加密对象头桶的桶头放得下
+func (h *FileHeader) maxMetaSize() int {
+	return maxBucketHeaderSize - h.bucketHeaderSize() - sizeOfExtChainLength - h.sizeOfChainNext() - sizeOfExtCodec -
+		sizeOfExtCipher - sizeOfExtExpires
+}
+
+// 编码元数据。每一项为 类型(1字节) + 长度(1字节) + 值，自定义的键值对的值又是 键长度 + 键 + 值长度 + 值
+func (m *Meta) encode() ([]byte, error) {
+	var data []byte
+	put := func(value string) error {
+		if len(value) > 255 {
+			return errors.New("Metadata is too large.")
+		}
+		data = append(data, uint8(len(value)))
+		data = append(data, value...)
+		return nil
+	}
+	if m.ContentType != "" {
+		data = append(data, metaContentType)
+		if err := put(m.ContentType); err != nil {
+			return nil, err
+		}
+	}
+	if m.FileName != "" {
+		data = append(data, metaFileName)
+		if err := put(m.FileName); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]string, 0, len(m.Headers))
+	for key := range m.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(key)+len(m.Headers[key]) > 253 {
+			return nil, errors.New("Metadata is too large.")
+		}
+		data = append(data, metaHeader, uint8(2+len(key)+len(m.Headers[key])))
+		put(key)
+		put(m.Headers[key])
+	}
+	return data, nil
+}
+
+func decodeMeta(data []byte) (*Meta, error) {
+	m := &Meta{}
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, errors.New("Invalid metadata.")
+		}
+		kind, value := data[0], data[2:2+int(data[1])]
+		switch kind {
+		case metaContentType:
+			m.ContentType = string(value)
+		case metaFileName:
+			m.FileName = string(value)
+		case metaHeader:
+			if len(value) < 1 || len(value) < 2+int(value[0]) || len(value) != 2+int(value[0])+int(value[1+int(value[0])]) {
+				return nil, errors.New("Invalid metadata.")
+			}
+			if m.Headers == nil {
+				m.Headers = make(map[string]string)
+			}
+			key := string(value[1 : 1+int(value[0])])
+			m.Headers[key] = string(value[2+int(value[0]):])
+		}
+		data = data[2+int(data[1]):]
+	}
+	return m, nil
+}
+
+// 元数据、过期时间和压缩方式在头桶的桶头中额外占用的大小，挑选文件时算在数据长度里
+func HeadSize(meta *Meta, codec Codec) int {
+	head := headExt{codec: codec}
+	if meta != nil {
+		head.expires = meta.Expires
+		if data, err := meta.encode(); err == nil && len(data) > 0 {
+			head.metaSize = metaAreaSize(len(data))
+		}
+	}
+	return head.size()
+}
+
+// 存放length长度的元数据时元数据区的大小
+func metaAreaSize(length int) int {
+	return (2 + length + metaAlign - 1) / metaAlign * metaAlign
+}
+
+// 为写入准备元数据区，调用者已经加锁
+func (h *FileHeader) newHeadExt(m *Meta) (headExt, error) {
+	if m == nil {
+		return headExt{}, nil
+	}
+	data, err := m.encode()
+	if err != nil {
+		return headExt{}, err
+	}
+	if (len(data) > 0 || m.Expires != 0) && !h.hasChecksum() {
+		return headExt{}, errors.New("Metadata is not supported by this file version.")
+	}
+	if len(data) == 0 {
+		return headExt{expires: m.Expires}, nil
+	}
+	size := metaAreaSize(len(data))
+	if size > h.maxMetaSize() {
+		size = h.maxMetaSize()
+	}
+	if 2+len(data) > size {
+		return headExt{}, errors.New("Metadata is too large.")
+	}
+	return headExt{meta: data, metaSize: size, expires: m.Expires}, nil
+}
+
+// 写入数据的同时写入元数据，返回头桶的索引和代数
+func (f *File) WriteWithMeta(r io.Reader, n int64, meta *Meta) (int64, uint32, error) {
+	return f.WriteCompressed(r, n, meta, CODEC_NONE, n)
+}
+
+// 读取对象的元数据，generation不为0时先检查桶的代数。不是对象的桶返回空的元数据，过期的对象返回ErrExpired
+func (f *File) ObjectMeta(index int64, generation uint32) (*Meta, error) {
+	bucket, err := f.bucketAt(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := bucket.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+	if err := bucket.checkExpires(); err != nil {
+		return nil, err
+	}
+	meta, err := decodeMeta(bucket.ext.meta)
+	if err != nil {
+		return nil, err
+	}
+	meta.Expires = bucket.ext.expires
+	return meta, nil
+}
+
+// 修改对象的元数据，generation不为0时先检查桶的代数。修改后的元数据不能超过写入时保留的大小。
+// 写入时带有过期时间的对象可以修改过期时间，但是不能去掉，也不能给写入时没有过期时间的对象加上
+func (f *File) UpdateMeta(index int64, generation uint32, update func(meta *Meta)) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return errors.New("Index overflows.")
+	}
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+
+	pointerToBucket := f.fh.indexToPointer(index)
+	bucket, err := f.readMeta(pointerToBucket)
+	if err != nil {
+		return err
+	}
+	if err := bucket.checkGeneration(generation); err != nil {
+		return err
+	}
+	if !bucket.isUsed() && !bucket.isDeleted() {
+		return errors.New("Bucket is not in use.")
+	}
+	meta, err := decodeMeta(bucket.ext.meta)
+	if err != nil {
+		return err
+	}
+	meta.Expires = bucket.ext.expires
+	update(meta)
+	data, err := meta.encode()
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && 2+len(data) > bucket.ext.metaSize {
+		return errors.New("Metadata is too large.")
+	}
+	if (meta.Expires == 0) != (bucket.ext.expires == 0) {
+		return errors.New("Expiry can not be added or removed.")
+	}
+	bucket.ext.meta, bucket.ext.expires = data, meta.Expires
+	f.touch(index)
+	return f.writeBucket(pointerToBucket, bucket)
+}
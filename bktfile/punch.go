@@ -0,0 +1,85 @@
+package bktfile
+
+import (
+	"errors"
+	"os"
+)
+
+// 打洞：回收桶的时候释放桶中数据部分占用的磁盘空间，桶头不动。删除了大部分数据的文件占用的磁盘空间和实际的数据差不多。
+// 支持打洞的文件系统上，CreateFile和Extend创建的都是稀疏文件，没有写过的桶不占用磁盘空间；需要预先分配时调用Preallocate。
+
+var (
+	errPunchNotSupported    = errors.New("Punching holes is not supported.")
+	errAllocateNotSupported = errors.New("Preallocation is not supported.")
+)
+
+// 存储实现了PunchHole时用它来打洞，比如MemStorage
+type holePuncher interface {
+	PunchHole(offset int64, length int64) error
+}
+
+// 释放存储中[offset, offset+length)的空间，调用者已经加锁
+func (f *File) punchHole(offset int64, length int64) error {
+	switch s := f.storage.(type) {
+	case holePuncher:
+		return s.PunchHole(offset, length)
+	case *os.File:
+		return punchFile(s, offset, length)
+	}
+	return errPunchNotSupported
+}
+
+// 设置回收桶时是否打洞。存储或者文件系统不支持时返回错误
+func (f *File) SetPunchHoles(on bool) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if on {
+		if f.writer == nil {
+			return errors.New("File not writealbe.")
+		}
+		// 在文件末尾之后试一下，不影响文件的内容
+		if err := f.punchHole(f.fh.fileSize(), 1); err != nil {
+			return err
+		}
+	}
+	f.punchHoles = on
+	f.freed = nil
+	return nil
+}
+
+// 记下回收的桶，修改提交之后打洞。调用者已经加锁
+func (f *File) free(index int64) {
+	if f.punchHoles {
+		f.freed = append(f.freed, index)
+	}
+}
+
+// 给回收的桶打洞。桶头可能的最大大小之后的部分才打洞，空桶的桶头仍然完整。
+// 打洞失败时不影响回收，桶中的数据留在原地。调用者已经加锁
+func (f *File) punchFreed() {
+	freed := f.freed
+	f.freed = nil
+	if int(f.fh.BucketSize) <= maxBucketHeaderSize {
+		return
+	}
+	for _, index := range freed {
+		pointer := f.fh.indexToPointer(index) + maxBucketHeaderSize
+		f.punchHole(pointer, int64(f.fh.BucketSize)-maxBucketHeaderSize)
+	}
+}
+
+// 为所有的桶预先分配磁盘空间，之后写入不会因为磁盘满而失败
+func (f *File) Preallocate() error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	file, ok := f.storage.(*os.File)
+	if !ok {
+		return errAllocateNotSupported
+	}
+	return allocateFile(file, 0, f.fh.fileSize())
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package bktfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// linux/falloc.h
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// 释放文件中[offset, offset+length)占用的磁盘空间，文件大小不变，读出来是0
+func punchFile(file *os.File, offset int64, length int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+}
+
+// 为文件中[offset, offset+length)分配磁盘空间
+func allocateFile(file *os.File, offset int64, length int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocKeepSize, offset, length)
+}
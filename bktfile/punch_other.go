@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package bktfile
+
+import (
+	"os"
+)
+
+func punchFile(file *os.File, offset int64, length int64) error {
+	return errPunchNotSupported
+}
+
+func allocateFile(file *os.File, offset int64, length int64) error {
+	return errAllocateNotSupported
+}
@@ -0,0 +1,107 @@
+package bktfile
+
+import (
+	"math/bits"
+)
+
+// 文件中桶和数据的统计
+type Stats struct {
+	Buckets int64 // 桶个数
+	Empty   int64 // 空桶
+	Used    int64 // 使用中的对象
+	Deleted int64 // 回收站中的对象
+	Error   int64 // 错误状态的桶
+	Chained int64 // 链式对象除头桶之外的桶
+
+	// 使用中和回收站中对象存放的数据长度，以及这些对象占用的桶的大小，两者的差是桶头和桶中没有用到的空间
+	Payload   int64
+	Allocated int64
+
+	// 使用中和回收站中对象最早和最晚的写入时间，没有对象时为0
+	Oldest int64
+	Newest int64
+
+	// 对象数据长度的分布：Histogram[0]是长度为0的对象个数，Histogram[i]是长度在[2^(i-1), 2^i)之间的对象个数
+	Histogram []int64
+}
+
+// 数据长度在直方图中的位置
+func histogramSlot(length int64) int {
+	return bits.Len64(uint64(length))
+}
+
+// 把另一个统计加到这个统计中，用于汇总多个文件
+func (s *Stats) Merge(o Stats) {
+	s.Buckets += o.Buckets
+	s.Empty += o.Empty
+	s.Used += o.Used
+	s.Deleted += o.Deleted
+	s.Error += o.Error
+	s.Chained += o.Chained
+	s.Payload += o.Payload
+	s.Allocated += o.Allocated
+	if o.Oldest != 0 && (s.Oldest == 0 || o.Oldest < s.Oldest) {
+		s.Oldest = o.Oldest
+	}
+	if o.Newest > s.Newest {
+		s.Newest = o.Newest
+	}
+	for len(s.Histogram) < len(o.Histogram) {
+		s.Histogram = append(s.Histogram, 0)
+	}
+	for i, n := range o.Histogram {
+		s.Histogram[i] += n
+	}
+}
+
+// 使用中和回收站中对象的数据长度占桶的大小的比例，没有对象时为0
+func (s *Stats) Utilization() float64 {
+	if s.Allocated == 0 {
+		return 0
+	}
+	return float64(s.Payload) / float64(s.Allocated)
+}
+
+// 遍历所有的桶头得到文件的统计。遍历期间文件仍然可以修改，统计是近似的
+func (f *File) Stats() (Stats, error) {
+	fh := f.FileHeader()
+	s := Stats{Buckets: fh.NumberOfBuckets}
+	err := f.scan(func(index int64, bucket *bucketHeader) error {
+		switch {
+		case bucket.isEmpty():
+			s.Empty++
+			return nil
+		case bucket.isError():
+			s.Error++
+			return nil
+		case bucket.isChained():
+			s.Chained++
+			s.Allocated += int64(fh.BucketSize)
+			return nil
+		}
+		length, ok := bucket.objectLength()
+		if !ok {
+			return nil
+		}
+		if bucket.isUsed() {
+			s.Used++
+		} else {
+			s.Deleted++
+		}
+		s.Payload += length
+		s.Allocated += int64(fh.BucketSize)
+		if s.Oldest == 0 || bucket.TimeStamp < s.Oldest {
+			s.Oldest = bucket.TimeStamp
+		}
+		if bucket.TimeStamp > s.Newest {
+			s.Newest = bucket.TimeStamp
+		}
+		slot := histogramSlot(length)
+		for len(s.Histogram) <= slot {
+			s.Histogram = append(s.Histogram, 0)
+		}
+		s.Histogram[slot]++
+		return nil
+	})
+	return s, err
+}
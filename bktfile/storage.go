@@ -0,0 +1,165 @@
+package bktfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// 桶文件的存储。文件的读写都按位置进行，Seek只用来取得存储的大小。
+// 存储实现了Truncate(size int64) error时，文件可以创建和扩大；实现了Sync() error时，写入可以同步；
+// 实现了Name() string时，用作文件名。*os.File实现了所有这些方法。
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+}
+
+// 存储的大小
+func storageSize(s io.Seeker) (int64, error) {
+	return s.Seek(0, io.SeekEnd)
+}
+
+// 存储的名字，没有Name方法时为空
+func storageName(s Storage) string {
+	if n, ok := s.(interface {
+		Name() string
+	}); ok {
+		return n.Name()
+	}
+	return ""
+}
+
+// 打开操作系统中的文件作为存储，flag和perm同os.OpenFile。也可以打开块设备，块设备不能创建和扩大
+func OpenStorage(name string, flag int, perm os.FileMode) (Storage, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// 内存中的存储，可以用在测试中，或者存放临时的桶文件。
+// Close不释放数据，关闭之后可以再次Open
+type MemStorage struct {
+	lock sync.RWMutex
+	name string
+	data []byte
+	pos  int64
+}
+
+func NewMemStorage(name string) *MemStorage {
+	return &MemStorage{name: name}
+}
+
+func (m *MemStorage) ReadAt(p []byte, off int64) (int, error) {
+	defer m.lock.RUnlock()
+	m.lock.RLock()
+
+	if off < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemStorage) WriteAt(p []byte, off int64) (int, error) {
+	defer m.lock.Unlock()
+	m.lock.Lock()
+
+	if off < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.resize(end)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *MemStorage) Seek(offset int64, whence int) (int64, error) {
+	defer m.lock.Unlock()
+	m.lock.Lock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// 改变存储的大小，扩大的部分是0
+func (m *MemStorage) Truncate(size int64) error {
+	defer m.lock.Unlock()
+	m.lock.Lock()
+
+	if size < 0 {
+		return errors.New("Invalid size.")
+	}
+	m.resize(size)
+	return nil
+}
+
+// 调用者已经加锁
+func (m *MemStorage) resize(size int64) {
+	if size <= int64(len(m.data)) {
+		m.data = m.data[:size]
+		return
+	}
+	if size <= int64(cap(m.data)) {
+		tail := m.data[len(m.data):size]
+		for i := range tail {
+			tail[i] = 0
+		}
+		m.data = m.data[:size]
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, m.data)
+	m.data = data
+}
+
+// 把[offset, offset+length)清成0，存储大小不变
+func (m *MemStorage) PunchHole(offset int64, length int64) error {
+	defer m.lock.Unlock()
+	m.lock.Lock()
+
+	if offset < 0 || length < 0 {
+		return errors.New("Invalid range.")
+	}
+	if end := int64(len(m.data)); offset+length > end {
+		length = end - offset
+	}
+	for i := int64(0); i < length; i++ {
+		m.data[offset+i] = 0
+	}
+	return nil
+}
+
+func (m *MemStorage) Sync() error {
+	return nil
+}
+
+func (m *MemStorage) Close() error {
+	return nil
+}
+
+func (m *MemStorage) Name() string {
+	return m.name
+}
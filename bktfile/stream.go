@@ -0,0 +1,464 @@
+package bktfile
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// 写入时每次从io.Reader读取的数据大小
+const streamChunkSize = 32 * 1024
+
+// 文件中没有足够的空桶。返回这两个错误时还没有读取数据，调用者可以换一个文件写入
+var (
+	ErrFull    = errors.New("Bucket file is full.")
+	ErrNoSpace = errors.New("Not enough empty buckets.")
+)
+
+// 从r中读取n字节数据写入空桶。数据超过一个桶时和WriteChained一样链式存放。
+// 数据分块写入，不会一次读入内存。
+func (f *File) WriteFrom(r io.Reader, n int64) (int64, error) {
+	index, _, err := f.write(r, n, true, 0, headExt{})
+	return index, err
+}
+
+// 写入数据的过程：
+//  1. 加写锁从空桶链表中取出需要的桶，写文件头；
+//  2. 分块写入数据，每块写入时短暂加读锁，可以和读取以及其他写入并行；
+//  3. 加写锁写桶头。桶头最后写，写入之前桶仍然是空桶，读不到不完整的数据；
+//  4. 按同步方式等待数据到达磁盘。
+//
+// 如果中途失败，取出的桶重新放回空桶链表。timeStamp为0时使用当前时间。
+// head是只在头桶中的扩展项。文件设置了密钥时数据加密后写入。返回头桶的索引和代数。
+func (f *File) write(r io.Reader, length int64, chained bool, timeStamp int64, head headExt) (int64, uint32, error) {
+	if length < 0 {
+		return -1, 0, errors.New("Invalid data length.")
+	}
+	r, length, err := f.seal(r, length, &head)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	fh, indexes, generations, err := f.allocBuckets(length, chained, head.size())
+	if err != nil {
+		return -1, 0, err
+	}
+
+	if timeStamp == 0 {
+		timeStamp = time.Now().Unix()
+	}
+	if err = f.writeBuckets(&fh, indexes, generations, r, length, timeStamp, head); err != nil {
+		f.releaseBuckets(indexes)
+		return -1, 0, err
+	}
+	if err = f.durable(); err != nil {
+		return -1, 0, err
+	}
+	return indexes[0], generations[0], nil
+}
+
+// 从空桶链表中取出存放length长度数据需要的桶和桶的新代数，同时返回取桶时的文件头。
+// 头桶中还要留出headSize大小的扩展项
+func (f *File) allocBuckets(length int64, chained bool, headSize int) (FileHeader, []int64, []uint32, error) {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	// 头桶的扩展项占用数据的空间，需要的桶个数和数据多出headSize长度时相同，
+	// 但是链式对象的头桶要能放下扩展项
+	if headSize > 0 && length+int64(headSize) > int64(f.fh.BucketSize)-int64(f.fh.bucketHeaderSize()) &&
+		headSize >= f.fh.chainHeadCapacity() {
+		return f.fh, nil, nil, errors.New("Bucket header is too large.")
+	}
+	indexes, generations, err := f.alloc(length+int64(headSize), chained)
+	return f.fh, indexes, generations, err
+}
+
+func (f *File) alloc(length int64, chained bool) ([]int64, []uint32, error) {
+	if f.writer == nil {
+		return nil, nil, errors.New("File not writealbe.")
+	}
+
+	n := int64(1)
+	if length > int64(f.fh.BucketSize)-int64(f.fh.bucketHeaderSize()) {
+		if !chained {
+			return nil, nil, errors.New("Data is too long.")
+		}
+		if !f.fh.hasChain() {
+			return nil, nil, errors.New("Chained buckets are not supported by this file version.")
+		}
+		if n = f.fh.bucketsForLength(length); n <= 0 {
+			return nil, nil, errors.New("Data is too long.")
+		}
+	}
+
+	if f.fh.isFull() {
+		return nil, nil, ErrFull
+	}
+	if n > f.fh.NumberOfEmptyBuckets {
+		return nil, nil, ErrNoSpace
+	}
+
+	indexes := make([]int64, n)
+	generations := make([]uint32, n)
+	next := f.fh.IndexOfEmptyBucket
+	for i := range indexes {
+		if next < 0 || next >= f.fh.NumberOfBuckets {
+			return nil, nil, errors.New("Index of empty bucket overflows.")
+		}
+		bucket, err := f.readBucket(f.fh.indexToPointer(next))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bucket.isEmpty() {
+			return nil, nil, errors.New("Empty bucket wanted, but nonempty bucket found.")
+		}
+		indexes[i] = next
+		if f.fh.hasGeneration() {
+			generations[i] = nextGeneration(bucket.ext.generation)
+		}
+		f.touch(next)
+		next = bucket.indexOfNextEmptyBucket()
+		if next == 0 {
+			next = indexes[i] + 1
+		}
+	}
+
+	indexOfFirstBucket, numberOfEmptyBuckets := f.fh.IndexOfEmptyBucket, f.fh.NumberOfEmptyBuckets
+	f.fh.IndexOfEmptyBucket = next
+	f.fh.NumberOfEmptyBuckets -= n
+
+	// 写文件头，如果桶写失败，最多这些桶就废了，不至于文件坏掉。
+	// 使用日志时记下取出的桶，打开文件时没有完成的分配会被放回空桶链表
+	f.begin()
+	f.journalAlloc(indexes)
+	if err := f.end(f.flushHead()); err != nil {
+		f.fh.IndexOfEmptyBucket = indexOfFirstBucket
+		f.fh.NumberOfEmptyBuckets = numberOfEmptyBuckets
+		return nil, nil, err
+	}
+	return indexes, generations, nil
+}
+
+// 将allocBuckets取出的桶放回空桶链表，桶的代数不变
+func (f *File) releaseBuckets(indexes []int64) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	f.begin()
+	f.journalDone(indexes[0])
+	now := time.Now().Unix()
+	for i := len(indexes) - 1; i >= 0; i-- {
+		bucket, err := f.readMeta(f.fh.indexToPointer(indexes[i]))
+		if err != nil {
+			bucket = &bucketHeader{}
+		}
+		bucket.TimeStamp = now
+		if err := f.pushEmptyBucket(indexes[i], bucket); err != nil {
+			return f.end(err)
+		}
+	}
+	return f.end(f.flushHead())
+}
+
+// 把length长度的数据依次写入取出的桶
+func (f *File) writeBuckets(fh *FileHeader, indexes []int64, generations []uint32, r io.Reader, length int64, timeStamp int64, head headExt) error {
+	chained := len(indexes) > 1
+	buf := make([]byte, streamChunkSize)
+	rest := length
+	buckets := make([]*bucketHeader, len(indexes))
+	for i, index := range indexes {
+		bucket := &bucketHeader{}
+		capacity := int64(fh.BucketSize) - int64(fh.bucketHeaderSize())
+		if chained {
+			bucket.ext = bucketExt{hasChain: true, chainNext: INVALID_INDEX, chainNext64: fh.isWide()}
+			if i == 0 {
+				capacity = int64(fh.chainHeadCapacity())
+				bucket.ext.chainLength = length
+			} else {
+				capacity = int64(fh.chainCapacity())
+			}
+			if i+1 < len(indexes) {
+				bucket.ext.chainNext = indexes[i+1]
+			}
+		}
+		if i == 0 {
+			bucket.setStatus(BUCKET_STATUS_USED)
+		} else {
+			bucket.setStatus(BUCKET_STATUS_CHAINED)
+		}
+		bucket.ext.hasChecksum = fh.hasChecksum()
+		bucket.ext.hasGeneration = fh.hasGeneration()
+		bucket.ext.generation = generations[i]
+		if i == 0 {
+			bucket.ext.meta, bucket.ext.metaSize = head.meta, head.metaSize
+			bucket.ext.codec, bucket.ext.length = head.codec, head.length
+			bucket.ext.keyID, bucket.ext.nonce = head.keyID, head.nonce
+			bucket.ext.expires = head.expires
+			capacity -= int64(head.size())
+		}
+		if capacity > rest {
+			capacity = rest
+		}
+		bucket.DataLength = int32(capacity)
+		bucket.TimeStamp = timeStamp
+
+		// 校验和的值不影响桶头大小，先按桶头大小写数据，最后再写桶头
+		pointerToBucket := fh.indexToPointer(index)
+		pointer := pointerToBucket + int64(len(bucket.encode()))
+		crc := uint32(0)
+		for piece := capacity; piece > 0; {
+			chunk := buf
+			if int64(len(chunk)) > piece {
+				chunk = chunk[:piece]
+			}
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return err
+			}
+			crc = crc32.Update(crc, castagnoli, chunk)
+			if err := f.writeAt(chunk, pointer); err != nil {
+				return err
+			}
+			pointer += int64(len(chunk))
+			piece -= int64(len(chunk))
+		}
+		bucket.ext.checksum = crc
+		buckets[i] = bucket
+		rest -= capacity
+	}
+	return f.commitBuckets(indexes, buckets)
+}
+
+// 数据写完之后写桶头，头桶最后写
+func (f *File) commitBuckets(indexes []int64, buckets []*bucketHeader) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	f.begin()
+	f.journalDone(indexes[0])
+	for i := len(indexes) - 1; i >= 0; i-- {
+		if err := f.writeBucket(f.fh.indexToPointer(indexes[i]), buckets[i]); err != nil {
+			return f.end(err)
+		}
+	}
+	return f.end(nil)
+}
+
+// 写数据部分。写入的是已经取出的桶，不会和其他写入重叠，只需要读锁
+func (f *File) writeAt(data []byte, pointer int64) error {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	_, err := f.writer.WriteAt(data, pointer)
+	return err
+}
+
+// 桶中数据在文件中的一段
+type segment struct {
+	index       int64
+	pointer     int64 // 数据在文件中的位置
+	start       int64 // 在整个对象中的起始位置
+	length      int64
+	hasChecksum bool
+	checksum    uint32
+}
+
+// 读取桶中数据的io.ReadSeeker。
+// 从一段数据的开头顺序读到结尾时会校验这段数据，校验失败时最后一次Read不返回数据，只返回CorruptionError。
+type bucketReader struct {
+	f        *File
+	segments []segment
+	size     int64
+	pos      int64
+
+	// 正在校验的段，以及已经校验到的位置
+	crcSegment int
+	crcPos     int64
+	crc        uint32
+}
+
+// 打开指定桶，返回只能读取桶中数据的io.ReadSeeker和写入时间。
+// 链式对象会按顺序读取所有的桶。空桶或者不在使用中的桶返回没有数据的Reader。
+func (f *File) OpenReader(index int64) (io.ReadSeeker, int64, error) {
+	return f.OpenObject(index, 0)
+}
+
+// 和OpenReader一样打开指定桶，generation不为0时先检查桶的代数。加密、压缩过的数据读取时解密、解压
+func (f *File) OpenObject(index int64, generation uint32) (io.ReadSeeker, int64, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	r, timeStamp, head, err := f.openObject(index, generation)
+	if err != nil || head == nil {
+		return r, timeStamp, err
+	}
+	if r, err = f.opened(r, head); err != nil {
+		return nil, 0, err
+	}
+	if head.ext.codec == CODEC_NONE {
+		return r, timeStamp, nil
+	}
+	return &decodeReader{raw: r, codec: head.ext.codec, size: head.ext.length}, timeStamp, nil
+}
+
+// 打开桶中存放的数据，同时返回头桶。不在使用中的桶返回没有数据的Reader和nil的头桶。调用者已经加读锁
+func (f *File) openObject(index int64, generation uint32) (io.ReadSeeker, int64, *bucketHeader, error) {
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return nil, 0, nil, errors.New("Index overflows")
+	}
+	if f.reader == nil {
+		return nil, 0, nil, errors.New("File is not readable")
+	}
+
+	head, err := f.readBucket(f.fh.indexToPointer(index))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := head.checkGeneration(generation); err != nil {
+		return nil, 0, nil, err
+	}
+	if head.isError() {
+		return nil, 0, nil, &CorruptionError{Name: f.name, Index: index, Marked: true}
+	}
+	if !head.isUsed() {
+		return bytes.NewReader(nil), 0, nil, nil
+	}
+	if err := head.checkExpires(); err != nil {
+		return nil, 0, nil, err
+	}
+	br, err := f.openReader(index, head)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return br, head.TimeStamp, head, nil
+}
+
+// 按头桶的桶头打开数据，不检查桶的状态。调用者已经加读锁
+func (f *File) openReader(index int64, head *bucketHeader) (*bucketReader, error) {
+	length := int64(head.DataLength)
+	if head.ext.hasChain {
+		length = head.ext.chainLength
+	}
+	if length < int64(head.DataLength) || head.DataLength < 0 ||
+		head.DataLength > f.fh.BucketSize-int32(head.dataOffset()) {
+		return nil, errors.New("Invalid bucket data size.")
+	}
+
+	br := &bucketReader{f: f, size: length, crcSegment: -1}
+	bucket, start := head, int64(0)
+	var err error
+	for {
+		br.segments = append(br.segments, segment{
+			index:       index,
+			pointer:     f.fh.indexToPointer(index) + int64(bucket.dataOffset()),
+			start:       start,
+			length:      int64(bucket.DataLength),
+			hasChecksum: bucket.ext.hasChecksum,
+			checksum:    bucket.ext.checksum,
+		})
+		start += int64(bucket.DataLength)
+		if start >= length {
+			break
+		}
+
+		index = bucket.ext.chainNext
+		if !head.ext.hasChain || index < 0 || index >= f.fh.NumberOfBuckets ||
+			int64(len(br.segments)) >= f.fh.NumberOfBuckets {
+			return nil, errors.New("Broken bucket chain.")
+		}
+		if bucket, err = f.readBucket(f.fh.indexToPointer(index)); err != nil {
+			return nil, err
+		}
+		if bucket.isError() {
+			return nil, &CorruptionError{Name: f.name, Index: index, Marked: true}
+		}
+		if !bucket.isChained() || bucket.DataLength <= 0 || int64(bucket.DataLength) > length-start ||
+			bucket.DataLength > f.fh.BucketSize-int32(bucket.dataOffset()) {
+			return nil, errors.New("Broken bucket chain.")
+		}
+	}
+	return br, nil
+}
+
+func (r *bucketReader) Read(p []byte) (int, error) {
+	n, err := r.read(p)
+	if err != nil {
+		r.f.markError(err)
+	}
+	return n, err
+}
+
+func (r *bucketReader) read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	i := 0
+	for i+1 < len(r.segments) && r.segments[i+1].start <= r.pos {
+		i++
+	}
+	s := &r.segments[i]
+	offset := r.pos - s.start
+	if rest := s.length - offset; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := r.f.readAt(p, s.pointer+offset)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if s.hasChecksum {
+		if offset == 0 {
+			r.crcSegment, r.crcPos, r.crc = i, r.pos, 0
+		}
+		if r.crcSegment == i && r.crcPos == r.pos {
+			r.crc = crc32.Update(r.crc, castagnoli, p[:n])
+			r.crcPos += int64(n)
+			if r.crcPos == s.start+s.length && r.crc != s.checksum {
+				return 0, &CorruptionError{Name: r.f.Name(), Index: s.index, Expected: s.checksum, Actual: r.crc}
+			}
+		}
+	}
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (f *File) readAt(p []byte, pointer int64) (int, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if f.reader == nil {
+		return 0, errors.New("File is not readable")
+	}
+	return f.reader.ReadAt(p, pointer)
+}
+
+func (r *bucketReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	r.pos = offset
+	return offset, nil
+}
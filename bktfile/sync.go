@@ -0,0 +1,100 @@
+package bktfile
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 写入数据之后怎样同步到磁盘
+type SyncMode int
+
+const (
+	SYNC_NONE   SyncMode = iota // 不主动同步，交给操作系统
+	SYNC_ALWAYS                 // 每次写入之后同步
+	SYNC_GROUP                  // 成组同步：等待一个间隔，这期间完成的写入共用一次同步
+)
+
+// 成组同步的默认间隔
+const defaultSyncInterval = 10 * time.Millisecond
+
+// 成组同步。第一个等待的写入者负责在间隔之后同步，之后到来的写入者等它同步完成。
+// 开始同步之前到来的写入者，数据都已经写完，所以都被这次同步覆盖。
+type groupSync struct {
+	lock     sync.Mutex
+	interval time.Duration
+	round    *syncRound
+}
+
+type syncRound struct {
+	done chan struct{}
+	err  error
+}
+
+func (g *groupSync) wait(sync func() error) error {
+	g.lock.Lock()
+	r := g.round
+	if r != nil {
+		g.lock.Unlock()
+		<-r.done
+		return r.err
+	}
+
+	r = &syncRound{done: make(chan struct{})}
+	g.round = r
+	g.lock.Unlock()
+
+	time.Sleep(g.interval)
+	g.lock.Lock()
+	g.round = nil
+	g.lock.Unlock()
+
+	r.err = sync()
+	close(r.done)
+	return r.err
+}
+
+// 设置写入之后的同步方式，interval只对SYNC_GROUP有效，为0时使用默认间隔。
+// 使用日志的文件每次写入都已经同步过日志和数据，不再另外同步。
+func (f *File) SetSync(mode SyncMode, interval time.Duration) {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	f.syncMode = mode
+	f.group = nil
+	if mode == SYNC_GROUP {
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		f.group = &groupSync{interval: interval}
+	}
+}
+
+// 把文件同步到磁盘
+func (f *File) Sync() error {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+	return f.sync()
+}
+
+// 按同步方式等待写入的数据到达磁盘
+func (f *File) durable() error {
+	f.locker.RLock()
+	mode, group, journaled := f.syncMode, f.group, f.journal != nil
+	f.locker.RUnlock()
+
+	if journaled {
+		return nil
+	}
+	switch mode {
+	case SYNC_ALWAYS:
+		return f.Sync()
+	case SYNC_GROUP:
+		return group.wait(f.Sync)
+	}
+	return nil
+}
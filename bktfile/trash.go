@@ -0,0 +1,132 @@
+package bktfile
+
+import (
+	"errors"
+	"time"
+)
+
+// 回收站：Delete只把桶标记为'd'，数据保留，可以用Restore恢复。
+// Purge或者PurgeDeleted才真正把桶放回空桶链表。
+// 和Empty一样，桶状态改变时TimeStamp记录改变的时间，所以回收站中桶的TimeStamp就是删除时间。
+// 改变状态不会改变桶头大小，数据保持原位。
+
+// 将桶放入回收站
+func (f *File) Delete(index int64) error {
+	return f.setDeleted(index, true, time.Now().Unix(), 0)
+}
+
+// 从回收站中恢复桶
+func (f *File) Restore(index int64) error {
+	return f.setDeleted(index, false, time.Now().Unix(), 0)
+}
+
+// generation不为0时检查桶的代数
+func (f *File) setDeleted(index int64, deleted bool, timeStamp int64, generation uint32) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return errors.New("Index overflows.")
+	}
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+
+	pointerToBucket := f.fh.indexToPointer(index)
+	bucket, err := f.readBucket(pointerToBucket)
+	if err != nil {
+		return err
+	}
+	if err := bucket.checkGeneration(generation); err != nil {
+		return err
+	}
+	f.touch(index)
+
+	if deleted {
+		if !bucket.isUsed() {
+			return errors.New("Bucket is not in use.")
+		}
+		bucket.setStatus(BUCKET_STATUS_DELETED)
+	} else {
+		if !bucket.isDeleted() {
+			return errors.New("Bucket is not deleted.")
+		}
+		bucket.setStatus(BUCKET_STATUS_USED)
+	}
+	bucket.TimeStamp = timeStamp
+	return f.writeBucket(pointerToBucket, bucket)
+}
+
+// 彻底回收已经放入回收站的桶
+func (f *File) Purge(index int64) error {
+	return f.PurgeObject(index, 0)
+}
+
+// 和Purge一样彻底回收回收站中的对象，generation不为0时先检查桶的代数。不在回收站中的对象不回收
+func (f *File) PurgeObject(index int64, generation uint32) error {
+	return f.purge(index, generation, 0)
+}
+
+// before不为0时只回收在before之前放入回收站的桶
+func (f *File) purge(index int64, generation uint32, before int64) error {
+	defer f.locker.Unlock()
+	f.locker.Lock()
+
+	if index < 0 || index >= f.fh.NumberOfBuckets {
+		return errors.New("Index overflows.")
+	}
+	if f.writer == nil {
+		return errors.New("File not writealbe.")
+	}
+
+	bucket, err := f.readBucket(f.fh.indexToPointer(index))
+	if err != nil {
+		return err
+	}
+	if err := bucket.checkGeneration(generation); err != nil {
+		return err
+	}
+	if !bucket.isDeleted() {
+		return errors.New("Bucket is not deleted.")
+	}
+	if before != 0 && bucket.TimeStamp >= before {
+		return errors.New("Bucket is deleted too recently.")
+	}
+	f.begin()
+	return f.end(f.empty(index))
+}
+
+// 回收站中所有桶的索引
+func (f *File) Deleted() ([]int64, error) {
+	var indexes []int64
+	err := f.scan(func(index int64, bucket *bucketHeader) error {
+		if bucket.isDeleted() {
+			indexes = append(indexes, index)
+		}
+		return nil
+	})
+	return indexes, err
+}
+
+// 彻底回收在before(从1970年1月1日开始的秒数)之前放入回收站的桶，返回回收的桶个数
+func (f *File) PurgeDeleted(before int64) (int, error) {
+	var indexes []int64
+	err := f.scan(func(index int64, bucket *bucketHeader) error {
+		if bucket.isDeleted() && bucket.TimeStamp < before {
+			indexes = append(indexes, index)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, index := range indexes {
+		// 扫描之后可能已经被恢复，或者恢复后又重新删除
+		if err := f.purge(index, 0, before); err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,141 @@
+package bktfile
+
+import (
+	"errors"
+)
+
+// 依次读取每个桶的桶头，fn返回错误时停止。每读一个桶头短暂加读锁，调用fn时不持有锁
+func (f *File) scan(fn func(index int64, bucket *bucketHeader) error) error {
+	for index := int64(0); ; index++ {
+		bucket, err := f.nextBucket(index)
+		if err != nil || bucket == nil {
+			return err
+		}
+		if err := fn(index, bucket); err != nil {
+			return err
+		}
+	}
+}
+
+// 读取桶头，index超出桶个数时返回nil
+func (f *File) nextBucket(index int64) (*bucketHeader, error) {
+	defer f.locker.RUnlock()
+	f.locker.RLock()
+
+	if f.reader == nil {
+		return nil, errors.New("File is not readable")
+	}
+	if index >= f.fh.NumberOfBuckets {
+		return nil, nil
+	}
+	return f.readBucket(f.fh.indexToPointer(index))
+}
+
+// 按索引顺序遍历所有的桶，只读取桶头。fn返回错误时停止遍历，并返回这个错误。
+// 空桶的DataLength是下一个空桶的索引；链式对象每个桶的DataLength只是本桶中数据的长度。
+func (f *File) Walk(fn func(index int64, b Bucket) error) error {
+	return f.scan(func(index int64, bucket *bucketHeader) error {
+		return fn(index, bucket.Bucket)
+	})
+}
+
+// 遍历的过滤条件
+type Filter struct {
+	Status []int8 // 只包括这些状态的桶，为空时包括所有状态
+	From   int64  // 只包括TimeStamp在[From, To)之间的桶，为0时不限制
+	To     int64
+}
+
+func (ft *Filter) match(b *Bucket) bool {
+	if len(ft.Status) > 0 {
+		found := false
+		for _, status := range ft.Status {
+			if b.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if ft.From != 0 && b.TimeStamp < ft.From {
+		return false
+	}
+	if ft.To != 0 && b.TimeStamp >= ft.To {
+		return false
+	}
+	return true
+}
+
+// 按过滤条件顺序遍历桶的迭代器
+//
+//	it := f.Iterate(Filter{Status: []int8{BUCKET_STATUS_USED}})
+//	for it.Next() {
+//		fmt.Println(it.Index(), it.Length())
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator struct {
+	f      *File
+	filter Filter
+	index  int64
+	bucket *bucketHeader
+	err    error
+}
+
+func (f *File) Iterate(filter Filter) *Iterator {
+	return &Iterator{f: f, filter: filter, index: -1}
+}
+
+// 移动到下一个符合条件的桶，没有了或者出错时返回false
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for {
+		it.index++
+		bucket, err := it.f.nextBucket(it.index)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if bucket == nil {
+			break
+		}
+		if it.filter.match(&bucket.Bucket) {
+			it.bucket = bucket
+			return true
+		}
+	}
+	it.bucket = nil
+	return false
+}
+
+func (it *Iterator) Index() int64 {
+	return it.index
+}
+
+func (it *Iterator) Bucket() Bucket {
+	return it.bucket.Bucket
+}
+
+// 数据长度，链式对象的头桶返回整个对象的长度，空桶返回0
+func (it *Iterator) Length() int64 {
+	if it.bucket.isEmpty() {
+		return 0
+	}
+	if it.bucket.ext.chainLength > 0 {
+		return it.bucket.ext.chainLength
+	}
+	return int64(it.bucket.DataLength)
+}
+
+// 读取当前桶的数据，和Read一样
+func (it *Iterator) Data() ([]byte, int64, error) {
+	return it.f.Read(it.index)
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
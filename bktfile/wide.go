@@ -0,0 +1,101 @@
+package bktfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// 1.0版本：文件头中桶的个数、空桶个数和空桶链表头是64位的，桶的索引也是64位的。
+// 桶头中链式桶的下一个桶用8字节的chainNext存放；空桶的下一个空桶仍然放在DataLength中，
+// 超过32位时改放在8字节的chainNext中。0.x版本的文件照常读写，桶个数不能超过int32。
+
+// 0.x版本的最后一个次版本号
+const lastMinorVersion0 uint8 = 6
+
+// 链式桶下一个桶的索引(8字节)
+const sizeOfExtChainNext64 = 2 + 8
+
+// 认识的版本
+func (h *FileHeader) knownVersion() bool {
+	switch h.MajorVersion {
+	case 0:
+		return h.MinorVersion <= lastMinorVersion0
+	case majorVersion:
+		return h.MinorVersion <= minorVersion
+	}
+	return false
+}
+
+// 1.0版本开始，桶的个数和索引是64位的
+func (h *FileHeader) isWide() bool {
+	return h.atLeast(1, 0)
+}
+
+// 文件头在文件中的大小
+func (h *FileHeader) encodedSize() int {
+	if h.isWide() {
+		return sizeOfFileHeader
+	}
+	return sizeOfFileHeader0
+}
+
+// 按版本能存放的最多的桶个数
+func (h *FileHeader) maxBuckets() int64 {
+	if !h.isWide() || h.BucketSize <= 0 {
+		return math.MaxInt32
+	}
+	return (math.MaxInt64 - 2*int64(h.HeaderSize)) / int64(h.BucketSize)
+}
+
+// 写入新数据时为链式桶的下一个索引留出的大小
+func (h *FileHeader) sizeOfChainNext() int {
+	if h.isWide() {
+		return sizeOfExtChainNext64
+	}
+	return sizeOfExtChainNext
+}
+
+// 按版本编码文件头
+func (h *FileHeader) encode() []byte {
+	var buf bytes.Buffer
+	if h.isWide() {
+		binary.Write(&buf, binary.LittleEndian, h)
+		return buf.Bytes()
+	}
+	binary.Write(&buf, binary.LittleEndian, fileHeader0{
+		h.Magic,
+		h.MajorVersion,
+		h.MinorVersion,
+		h.HeaderSize,
+		h.BucketSize,
+		int32(h.NumberOfBuckets),
+		int32(h.NumberOfEmptyBuckets),
+		int32(h.IndexOfEmptyBucket),
+	})
+	return buf.Bytes()
+}
+
+// 读取pointer处的文件头，先按0.x版本读，主版本号是1时再按1.0版本读
+func readFileHeader(r io.ReaderAt, pointer int64) (FileHeader, error) {
+	var h0 fileHeader0
+	if err := binary.Read(io.NewSectionReader(r, pointer, int64(sizeOfFileHeader0)), binary.LittleEndian, &h0); err != nil {
+		return FileHeader{}, err
+	}
+	if h0.MajorVersion == 0 {
+		return FileHeader{
+			h0.Magic,
+			h0.MajorVersion,
+			h0.MinorVersion,
+			h0.HeaderSize,
+			h0.BucketSize,
+			int64(h0.NumberOfBuckets),
+			int64(h0.NumberOfEmptyBuckets),
+			int64(h0.IndexOfEmptyBucket),
+		}, nil
+	}
+	var h FileHeader
+	err := binary.Read(io.NewSectionReader(r, pointer, int64(sizeOfFileHeader)), binary.LittleEndian, &h)
+	return h, err
+}
@@ -9,6 +9,7 @@ import (
 )
 
 func main() {
+	keyfile := flag.String("keys", "", "key file to decrypt encrypted data")
 	flag.Parse()
 	name := flag.Arg(0)
 
@@ -18,7 +19,7 @@ func main() {
 	}
 
 	arg2 := flag.Arg(1)
-	index, err := strconv.Atoi(arg2)
+	index, err := strconv.ParseInt(arg2, 10, 64)
 	if err != nil {
 		index = 0
 	}
@@ -31,11 +32,24 @@ func main() {
 
 	defer f.Close()
 
-	data, t, err := f.Read(int32(index))
+	if *keyfile != "" {
+		keys, err := bktfile.ReadKeyring(*keyfile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		f.SetKeyring(keys)
+	}
+
+	data, t, err := f.Read(index)
 	if err != nil {
 		fmt.Println(err)
 	}
 	fmt.Print(f.FileHeader())
+	fmt.Print(f.Identity())
+	if recovery := f.Recovery(); recovery != "" {
+		fmt.Println("header recovery:", recovery)
+	}
 	fmt.Println(time.Unix(t, 0).Format("2006-01-02 15:04:05"))
 	fmt.Println(string(data))
 }
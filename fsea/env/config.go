@@ -13,18 +13,114 @@ type File struct {
 	Name string
 }
 
+// 压缩后的文件id对应关系
+type Remap struct {
+	// 压缩前的文件id
+	Id string
+	// 压缩后的文件id
+	To string
+	// 桶索引对应表文件
+	Name string
+}
+
 type Bucket struct {
-	Id   string
-	Path string
-	File []*File
+	Id    string
+	Path  string
+	File  []*File
+	Remap []*Remap
+	// 写入之后的同步方式
+	Sync string
+	// 成组同步的间隔，单位毫秒
+	SyncInterval int64
+	// 回收桶时释放数据占用的磁盘空间
+	PunchHoles bool
+	// 新文件预先分配所有桶的磁盘空间，不设置时是稀疏文件
+	Preallocate bool
+	// 桶文件大小上限，单位字节，0表示DefaultMaxFileSize
+	MaxFileSize int64
 }
 
+// 默认的桶文件大小上限16G，考虑到文件复制、移动等因素
+const DefaultMaxFileSize = 1 << 34
+
+// 桶文件大小上限
+func (b *Bucket) MaxSize() int64 {
+	if b.MaxFileSize > 0 {
+		return b.MaxFileSize
+	}
+	return DefaultMaxFileSize
+}
+
+// 写入之后的同步方式
+const (
+	SyncNone   = ""       // 不主动同步
+	SyncAlways = "always" // 每次写入之后同步
+	SyncGroup  = "group"  // 成组同步
+)
+
 type Large struct {
 	Path string
 	Max  string
 	Fold string
 }
 
+type Trash struct {
+	// 回收站保留时间，单位秒。0表示不自动清理
+	Retention int64
+	// 清理间隔，单位秒
+	Interval int64
+}
+
+// 过期数据的回收
+type Expire struct {
+	// 回收间隔，单位秒。0表示不回收
+	Interval int64
+	// 每秒最多回收的数据个数，0表示不限制
+	Rate int
+}
+
+// 写入前压缩数据
+type Compress struct {
+	// 压缩方式，不设置时不压缩
+	Codec string
+	// 小于这个长度的数据不压缩，单位字节
+	Min int64
+	// 大于这个长度的数据不压缩，压缩在内存中进行，单位字节。0表示DefaultCompressMax
+	Max int64
+}
+
+// 默认的压缩数据长度上限16M，压缩在内存中进行，不能不限制
+const DefaultCompressMax = 16 << 20
+
+// 压缩数据长度上限
+func (c *Compress) MaxSize() int64 {
+	if c.Max > 0 {
+		return c.Max
+	}
+	return DefaultCompressMax
+}
+
+// 压缩方式
+const (
+	CodecNone = ""     // 不压缩
+	CodecGzip = "gzip" // gzip
+)
+
+// 挂载文件时检查文件的策略
+const (
+	FsckNone   = ""       // 不检查
+	FsckWarn   = "warn"   // 有问题时记录日志，继续挂载
+	FsckRefuse = "refuse" // 有问题时拒绝挂载
+	FsckRepair = "repair" // 有问题时自动修复
+)
+
+// 挂载文件时文件身份和配置不符的处理
+const (
+	IdentityWarn    = ""        // 记录日志后挂载，文件身份不变
+	IdentityRefuse  = "refuse"  // 拒绝挂载
+	IdentityRewrite = "rewrite" // 记录日志，按挂载的位置重写文件身份后挂载
+)
+
 type Config struct {
 	// id
 	Id string
@@ -40,6 +136,22 @@ type Config struct {
 	Bucket []*Bucket
 	// large对象
 	Large Large
+	// 回收站
+	Trash Trash
+	// 过期数据
+	Expire Expire
+	// 压缩
+	Compress Compress
+	// 挂载文件时的检查策略
+	Fsck string
+	// 挂载文件时文件身份和配置不符的处理
+	Identity string
+	// 桶文件是否使用日志
+	Journal bool
+	// 密钥文件，设置后新写入的数据加密存放
+	Keyfile string
+	// 去重索引文件，设置后内容相同的数据只存放一份
+	Dedup string
 }
 
 var config *Config
@@ -91,6 +203,12 @@ func (c *Config) AssignFile(bid string, seed string) (*Bucket, *File, error) {
 					maxId = fid
 				}
 			}
+			// 压缩掉的文件id也不能再用
+			for _, remap := range bucket.Remap {
+				if fid, err := strconv.ParseInt(remap.Id, 16, 64); err == nil && fid > maxId {
+					maxId = fid
+				}
+			}
 			fid := strconv.FormatInt(maxId+1, 16)
 			f := File{
 				Id:   fid,
@@ -102,6 +220,24 @@ func (c *Config) AssignFile(bid string, seed string) (*Bucket, *File, error) {
 	return nil, nil, errors.New("bid not found.")
 }
 
+// 根据桶id查找桶目录
+func (c *Config) GetBucket(bid string) *Bucket {
+	for _, bucket := range c.Bucket {
+		if bucket.Id == bid {
+			return bucket
+		}
+	}
+	return nil
+}
+
+// 桶目录中文件的大小上限，找不到桶目录时为DefaultMaxFileSize
+func (c *Config) MaxFileSize(bid string) int64 {
+	if bucket := c.GetBucket(bid); bucket != nil {
+		return bucket.MaxSize()
+	}
+	return DefaultMaxFileSize
+}
+
 // 将文件对象加入到配置中
 func (c *Config) AddFile(bid string, f *File) error {
 	for _, bucket := range c.Bucket {
@@ -125,3 +261,54 @@ func (c *Config) AddFileAndSave(bid string, f *File) error {
 	}
 	return c.Save()
 }
+
+// 从配置中去掉文件对象
+func (c *Config) RemoveFile(bid string, fid string) error {
+	for _, bucket := range c.Bucket {
+		if bucket.Id == bid {
+			for i, file := range bucket.File {
+				if file.Id == fid {
+					bucket.File = append(bucket.File[:i], bucket.File[i+1:]...)
+					return nil
+				}
+			}
+			return errors.New("fid not found")
+		}
+	}
+	return errors.New("bid not found")
+}
+
+// 文件fid压缩到新文件f之后更新配置：去掉旧文件，加入新文件，记录id对应关系
+func (c *Config) CompactFile(bid string, fid string, f *File, remapName string) error {
+	if err := c.AddFile(bid, f); err != nil {
+		return err
+	}
+	if err := c.RemoveFile(bid, fid); err != nil {
+		return err
+	}
+	for _, bucket := range c.Bucket {
+		if bucket.Id == bid {
+			bucket.Remap = append(bucket.Remap, &Remap{Id: fid, To: f.Id, Name: remapName})
+			return nil
+		}
+	}
+	return errors.New("bid not found")
+}
+
+// 更新压缩后的配置并保存，保存失败时恢复原来的配置
+func (c *Config) CompactFileAndSave(bid string, fid string, f *File, remapName string) error {
+	bucket := c.GetBucket(bid)
+	if bucket == nil {
+		return errors.New("bid not found")
+	}
+	files := append([]*File(nil), bucket.File...)
+	remaps := append([]*Remap(nil), bucket.Remap...)
+	err := c.CompactFile(bid, fid, f, remapName)
+	if err == nil {
+		err = c.Save()
+	}
+	if err != nil {
+		bucket.File, bucket.Remap = files, remaps
+	}
+	return err
+}
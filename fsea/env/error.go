@@ -13,6 +13,11 @@ const (
 	InvalidFileSize   = 104
 	FileNotFound      = 105
 	InvalidDataId     = 106
+	DataCorrupted     = 107
+	DataGone          = 108
+	DataExpired       = 109
+	FileLocked        = 110
+	FileMismatch      = 111
 )
 
 var statusText = map[int]string{
@@ -23,6 +28,11 @@ var statusText = map[int]string{
 	InvalidFileSize:   "File size is too large. the file size should smaller then 4GB",
 	FileNotFound:      "File is not found",
 	InvalidDataId:     "DataId is invalid",
+	DataCorrupted:     "Data is corrupted",
+	DataGone:          "Data is gone",
+	DataExpired:       "Data is expired",
+	FileLocked:        "File is locked by another process",
+	FileMismatch:      "File was created by another node or as another file",
 }
 
 type Error struct {
@@ -0,0 +1,317 @@
+package env
+
+import (
+	"bktfile"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 配置文件丢失或者损坏时，扫描桶目录中的桶文件，按文件头中的文件身份重建[[Bucket]]和[[Bucket.File]]。
+// 配置文件还能读取时保留其中的其他配置，只重建文件列表和压缩的对应关系。
+
+// 重建配置的结果
+type RebuildReport struct {
+	// 放进配置的文件个数
+	Placed int
+	// 冲突：同一个id的多个文件，同一个桶目录id的多个目录等
+	Conflicts []string
+	// 没有放进配置的文件和原因
+	Unplaced []string
+}
+
+func (r *RebuildReport) conflict(format string, a ...interface{}) {
+	r.Conflicts = append(r.Conflicts, fmt.Sprintf(format, a...))
+}
+
+func (r *RebuildReport) unplaced(name string, format string, a ...interface{}) {
+	r.Unplaced = append(r.Unplaced, name+": "+fmt.Sprintf(format, a...))
+}
+
+func (r *RebuildReport) String() string {
+	s := fmt.Sprintf("%d files placed, %d conflicts, %d files unplaced\n", r.Placed, len(r.Conflicts), len(r.Unplaced))
+	for _, c := range r.Conflicts {
+		s += "conflict: " + c + "\n"
+	}
+	for _, u := range r.Unplaced {
+		s += "unplaced: " + u + "\n"
+	}
+	return s
+}
+
+// 目录中的一个桶文件
+type scannedFile struct {
+	name     string
+	fid      string
+	identity bktfile.Identity
+}
+
+// 扫描到的一个桶目录
+type scannedDir struct {
+	bucket *Bucket
+	files  []*scannedFile
+	remaps []*Remap
+}
+
+// 从配置文件name和目录dirs重建配置，写回name，原来的配置文件改名为name.bak。
+// dirs中的目录可以写成"桶目录id=路径"，没有指定id时按目录中文件的身份确定
+func RebuildConfig(name string, dirs []string) (*Config, *RebuildReport, error) {
+	report := &RebuildReport{}
+	c, err := CreateConfig(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.conflict("config %s is not readable, rebuilt from scratch.[%s]", name, err.Error())
+		}
+		c = &Config{}
+		config, fileName = c, name
+	}
+
+	// 桶目录中可能有的其他文件
+	skip := map[string]bool{absPath(name): true}
+	if c.Dedup != "" {
+		skip[absPath(c.Dedup)] = true
+	}
+
+	var scanned []*scannedDir
+	paths := make(map[string]bool)
+	for _, bucket := range c.Bucket {
+		paths[filepath.Clean(bucket.Path)] = true
+		files, remaps, err := scanDir(bucket.Path, skip, report)
+		if err != nil {
+			// 目录读不了时保留原来的文件列表
+			report.conflict("bucket %s: %s, file list is kept", bucket.Id, err.Error())
+			continue
+		}
+		scanned = append(scanned, &scannedDir{bucket, files, remaps})
+	}
+	for _, dir := range dirs {
+		bucket := &Bucket{Path: dir}
+		if i := strings.Index(dir, "="); i != -1 {
+			bucket.Id, bucket.Path = dir[:i], dir[i+1:]
+		}
+		if paths[filepath.Clean(bucket.Path)] {
+			continue
+		}
+		paths[filepath.Clean(bucket.Path)] = true
+		files, remaps, err := scanDir(bucket.Path, skip, report)
+		if err != nil {
+			report.conflict("%s: %s", bucket.Path, err.Error())
+			continue
+		}
+		if bucket.Id == "" {
+			bucket.Id = guessBucketId(files)
+		}
+		if bucket.Id == "" {
+			for _, file := range files {
+				report.unplaced(filepath.Join(bucket.Path, file.name), "bucket id is unknown")
+			}
+			continue
+		}
+		if other := c.GetBucket(bucket.Id); other != nil {
+			report.conflict("bucket %s is both %s and %s", bucket.Id, other.Path, bucket.Path)
+			for _, file := range files {
+				report.unplaced(filepath.Join(bucket.Path, file.name), "bucket %s is used by %s", bucket.Id, other.Path)
+			}
+			continue
+		}
+		c.Bucket = append(c.Bucket, bucket)
+		scanned = append(scanned, &scannedDir{bucket, files, remaps})
+	}
+
+	if c.Id == "" {
+		c.Id = guessOwner(scanned)
+	}
+	for _, dir := range scanned {
+		placeFiles(c, dir, report)
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		if err := os.Rename(name, name+".bak"); err != nil {
+			return c, report, err
+		}
+	}
+	return c, report, c.Save()
+}
+
+// 扫描目录中的桶文件和压缩的索引对应表，skip中的文件不扫描。有日志的桶文件先按日志恢复
+func scanDir(dir string, skip map[string]bool, report *RebuildReport) ([]*scannedFile, []*Remap, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []*scannedFile
+	var remaps []*Remap
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		if skip[absPath(path)] {
+			continue
+		}
+		switch filepath.Ext(name) {
+		case ".journal", ".tmp", ".bak":
+			continue
+		case ".remap":
+			// 文件名是"压缩前的文件id_压缩后的文件id.remap"
+			ids := strings.SplitN(strings.TrimSuffix(name, ".remap"), "_", 2)
+			if len(ids) != 2 || !isFileId(ids[0]) || !isFileId(ids[1]) {
+				report.unplaced(path, "not a remap file name")
+				continue
+			}
+			if _, err := bktfile.ReadRemap(path); err != nil {
+				report.unplaced(path, "%s", err.Error())
+				continue
+			}
+			remaps = append(remaps, &Remap{Id: ids[0], To: ids[1], Name: name})
+			continue
+		}
+
+		// 崩溃留下的日志不恢复就不能只读打开。恢复时加排他锁
+		err := bktfile.Recover(path)
+		var f *bktfile.File
+		if err == nil {
+			f, err = bktfile.OpenFile(path, bktfile.OF_RDONLY)
+		}
+		if err != nil {
+			// 文件名不是.bkt的也可能是桶文件，打不开的都报告。加不上锁说明fsea还在运行
+			if _, ok := err.(*bktfile.LockError); ok {
+				report.conflict("%s is locked, fsea may be running", path)
+			}
+			report.unplaced(path, "%s", err.Error())
+			continue
+		}
+		files = append(files, &scannedFile{name: name, identity: f.Identity()})
+		f.Close()
+	}
+	return files, remaps, nil
+}
+
+// 比较用的绝对路径
+func absPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+// 16进制的文件id
+func isFileId(id string) bool {
+	_, err := strconv.ParseInt(id, 16, 64)
+	return err == nil
+}
+
+// 目录中最多的文件身份中的桶目录id
+func guessBucketId(files []*scannedFile) string {
+	count := make(map[string]int)
+	for _, file := range files {
+		if !file.identity.IsZero() {
+			count[file.identity.Bucket]++
+		}
+	}
+	return mostCommon(count)
+}
+
+// 所有文件身份中最多的节点
+func guessOwner(dirs []*scannedDir) string {
+	count := make(map[string]int)
+	for _, dir := range dirs {
+		for _, file := range dir.files {
+			if !file.identity.IsZero() {
+				count[file.identity.Owner]++
+			}
+		}
+	}
+	return mostCommon(count)
+}
+
+// 出现次数最多的值，次数相同时取最小的
+func mostCommon(count map[string]int) string {
+	var best string
+	for value, n := range count {
+		if n > count[best] || (n == count[best] && value < best) {
+			best = value
+		}
+	}
+	return best
+}
+
+// 按文件身份确定目录中每个文件的id，放进配置。没有身份的旧文件按文件名"文件id_桶大小.bkt"确定
+func placeFiles(c *Config, dir *scannedDir, report *RebuildReport) {
+	bucket := dir.bucket
+	bucket.File, bucket.Remap = nil, dir.remaps
+	compacted := make(map[string]string)
+	for _, r := range bucket.Remap {
+		compacted[r.Id] = r.To
+	}
+
+	byId := make(map[string][]*scannedFile)
+	for _, file := range dir.files {
+		path := filepath.Join(bucket.Path, file.name)
+		id := file.identity
+		switch {
+		case id.IsZero():
+			fid := strings.SplitN(file.name, "_", 2)[0]
+			if !strings.Contains(file.name, "_") || !isFileId(fid) {
+				report.unplaced(path, "no identity and file id is unknown")
+				continue
+			}
+			file.fid = fid
+		case id.Bucket != bucket.Id:
+			report.unplaced(path, "created as %s", transId(id.Bucket, id.File))
+			continue
+		default:
+			file.fid = id.File
+			if id.Owner != c.Id {
+				report.conflict("%s was created by %q", path, id.Owner)
+			}
+		}
+		if to, ok := compacted[file.fid]; ok {
+			report.unplaced(path, "compacted into %s", transId(bucket.Id, to))
+			continue
+		}
+		byId[file.fid] = append(byId[file.fid], file)
+	}
+
+	var fids []string
+	for fid := range byId {
+		fids = append(fids, fid)
+	}
+	sort.Strings(fids)
+	for _, fid := range fids {
+		files := byId[fid]
+		if len(files) > 1 {
+			var names []string
+			for _, file := range files {
+				names = append(names, file.name)
+			}
+			report.conflict("%s is used by %s", transId(bucket.Id, fid), strings.Join(names, ", "))
+			for _, file := range files {
+				report.unplaced(filepath.Join(bucket.Path, file.name), "file id %s conflicts", fid)
+			}
+			continue
+		}
+		bucket.File = append(bucket.File, &File{Id: fid, Name: files[0].name})
+		report.Placed++
+	}
+	sort.Sort(byFileId(bucket.File))
+}
+
+func transId(bid string, fid string) string {
+	return bid + ":" + fid
+}
+
+type byFileId []*File
+
+func (f byFileId) Len() int      { return len(f) }
+func (f byFileId) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byFileId) Less(i, j int) bool {
+	a, _ := strconv.ParseInt(f[i].Id, 16, 64)
+	b, _ := strconv.ParseInt(f[j].Id, 16, 64)
+	return a < b
+}
@@ -0,0 +1,143 @@
+package env
+
+import (
+	"bktfile"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 在dir中创建一个桶文件，fid不为空时记下身份
+func createBucketFile(t *testing.T, dir string, name string, fid string) {
+	f, err := bktfile.CreateFile(filepath.Join(dir, name), 0666, 4096, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fid == "" {
+		return
+	}
+	id, err := bktfile.NewIdentity("node1", "b", fid)
+	if err == nil {
+		err = f.SetIdentity(id)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "b")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	createBucketFile(t, dir, "0_1.bkt", "0")
+	// 两个文件都是1号文件
+	createBucketFile(t, dir, "1_1.bkt", "1")
+	createBucketFile(t, dir, "copy.bkt", "1")
+	// 2号文件压缩成了3号文件
+	createBucketFile(t, dir, "2_1.bkt", "2")
+	createBucketFile(t, dir, "3_1.bkt", "3")
+	if err := (&bktfile.Remap{}).Save(filepath.Join(dir, "2_3.remap")); err != nil {
+		t.Fatal(err)
+	}
+	// 没有身份的旧文件
+	createBucketFile(t, dir, "5_1.bkt", "")
+	// 崩溃时留下了日志
+	createBucketFile(t, dir, "6_1.bkt", "6")
+	f, err := bktfile.OpenFile(filepath.Join(dir, "6_1.bkt"), bktfile.OF_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.EnableJournal(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("journaled"))
+	journal, err := ioutil.ReadFile(filepath.Join(dir, "6_1.bkt.journal"))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "6_1.bkt.journal"), journal, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := bktfile.OpenFile(filepath.Join(dir, "6_1.bkt"), bktfile.OF_RDONLY); err == nil {
+		f.Close()
+		t.Fatal("journal should need replaying")
+	}
+	// 不是桶文件，但是不用报告
+	for _, n := range []string{"dedup", "fsea.conf.bak"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte("other"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 不是桶文件
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(tmp, "fsea.conf")
+	if err := ioutil.WriteFile(name, []byte("Dedup = \""+filepath.Join(dir, "dedup")+"\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, report, err := RebuildConfig(name, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id != "node1" || len(c.Bucket) != 1 {
+		t.Fatalf("config: id %q, %d buckets", c.Id, len(c.Bucket))
+	}
+	bucket := c.Bucket[0]
+	if bucket.Id != "b" || bucket.Path != dir {
+		t.Errorf("bucket %s at %s", bucket.Id, bucket.Path)
+	}
+	files := []File{{"0", "0_1.bkt"}, {"3", "3_1.bkt"}, {"5", "5_1.bkt"}, {"6", "6_1.bkt"}}
+	if len(bucket.File) != len(files) {
+		t.Fatalf("%d files placed, want %d", len(bucket.File), len(files))
+	}
+	for i, f := range bucket.File {
+		if *f != files[i] {
+			t.Errorf("file %d: %v, want %v", i, *f, files[i])
+		}
+	}
+	if len(bucket.Remap) != 1 || *bucket.Remap[0] != (Remap{"2", "3", "2_3.remap"}) {
+		t.Errorf("remaps: %v", bucket.Remap)
+	}
+
+	if report.Placed != len(files) {
+		t.Errorf("report: %d placed, want %d", report.Placed, len(files))
+	}
+	if len(report.Conflicts) != 1 || !strings.Contains(report.Conflicts[0], "b:1") {
+		t.Errorf("conflicts: %v", report.Conflicts)
+	}
+	var unplaced []string
+	for _, u := range report.Unplaced {
+		unplaced = append(unplaced, filepath.Base(strings.SplitN(u, ": ", 2)[0]))
+	}
+	sort.Strings(unplaced)
+	if want := []string{"1_1.bkt", "2_1.bkt", "copy.bkt", "notes.txt"}; !reflect.DeepEqual(unplaced, want) {
+		t.Errorf("unplaced: %v, want %v", unplaced, want)
+	}
+
+	// 再次重建时从保存的配置出发，原来的配置文件改名为.bak
+	c2, report, err := RebuildConfig(name, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name + ".bak"); err != nil {
+		t.Error(err)
+	}
+	if len(c2.Bucket) != 1 || len(c2.Bucket[0].File) != len(files) || report.Placed != len(files) {
+		t.Errorf("rebuilt again: %d buckets, %d placed", len(c2.Bucket), report.Placed)
+	}
+}
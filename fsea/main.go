@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"fsea/env"
 	"fsea/module"
@@ -23,16 +24,50 @@ func main() {
 	f, _ := filepath.Abs(os.Getenv("_"))
 	p := path.Dir(path.Dir(f))
 	name := p + "/conf/fsea.conf"
+
+	// 配置文件丢失时从桶文件重建：fsea -rebuild [桶目录id=]目录...
+	rebuild := flag.Bool("rebuild", false, "rebuild the config from bucket files in the configured and given directories")
+	flag.Parse()
+	if *rebuild {
+		_, report, err := env.RebuildConfig(name, flag.Args())
+		if report != nil {
+			fmt.Print(report)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
 	c, err := env.CreateConfig(name)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	pool.GetPool()
+	if _, err := pool.CreatePool(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if c.Trash.Retention > 0 {
+		interval := c.Trash.Interval
+		if interval <= 0 {
+			interval = 3600
+		}
+		go pool.GetPool().Sweep(time.Duration(c.Trash.Retention)*time.Second, time.Duration(interval)*time.Second)
+	}
+	// 回收过期数据要扫描所有文件的桶头，配置了间隔才启动
+	if c.Expire.Interval > 0 {
+		go pool.GetPool().Reap(time.Duration(c.Expire.Interval)*time.Second, c.Expire.Rate)
+	}
 
 	dispatcher.AddModule("mount", module.Mount{})
 	dispatcher.AddModule("umount", module.Umount{})
+	dispatcher.AddModule("trash", module.Trash{})
+	dispatcher.AddModule("extend", module.Extend{})
+	dispatcher.AddModule("compact", module.Compact{})
+	dispatcher.AddModule("rekey", module.Rekey{})
+	dispatcher.AddModule("stats", module.Stats{})
 	go http.ListenAndServe(fmt.Sprintf(":%d", c.AdminPort), &dispatcher)
 
 	s := &http.Server{
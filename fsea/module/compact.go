@@ -0,0 +1,52 @@
+package module
+
+import (
+	"fsea/env"
+	"fsea/pool"
+	"gwf"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 把已挂载的文件压缩到新文件，旧的数据id仍然可以访问
+// /compact/[File ID]
+type Compact struct {
+}
+
+func (c Compact) Action(ctx *gwf.Context) {
+	w := ctx.Writer()
+	if ctx.Depth() != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, _ := ctx.Path(1)
+	p := pool.GetPool()
+	f := p.GetFile(id)
+	sep := strings.LastIndex(id, ":")
+	if f == nil || sep == -1 {
+		writeError(w, http.StatusBadRequest, env.NewError(InvalidFileId, id))
+		return
+	}
+	bucketId, fid := id[:sep], id[sep+1:]
+
+	config := env.GetConfig()
+	seed := strconv.FormatInt(int64(f.File().FileHeader().BucketSize/4096), 10)
+	b, newFile, err := config.AssignFile(bucketId, seed)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	fullName := b.Path + "/" + newFile.Name
+	remapName := fid + "_" + newFile.Id + ".remap"
+
+	err = p.CompactFile(bucketId, fid, newFile.Id, fullName, b.Path+"/"+remapName, func() error {
+		return config.CompactFileAndSave(bucketId, fid, newFile, remapName)
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	responseFile(w, pool.TransId(bucketId, newFile.Id), fullName)
+}
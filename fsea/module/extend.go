@@ -0,0 +1,52 @@
+package module
+
+import (
+	"fsea/env"
+	"fsea/pool"
+	"gwf"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 给已挂载的文件增加空桶
+// /extend/[File ID]/[Bucket Count]
+type Extend struct {
+}
+
+func (e Extend) Action(ctx *gwf.Context) {
+	w := ctx.Writer()
+	if ctx.Depth() != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, _ := ctx.Path(1)
+	p2, _ := ctx.Path(2)
+	additionalBuckets, err := strconv.ParseInt(p2, 10, 64)
+	if err != nil || additionalBuckets < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	p := pool.GetPool()
+	f := p.GetFile(id)
+	if f == nil {
+		writeError(w, http.StatusBadRequest, env.NewError(InvalidFileId, id))
+		return
+	}
+
+	fh := f.File().FileHeader()
+	bucketId := strings.SplitN(id, ":", 2)[0]
+	if additionalBuckets > (env.GetConfig().MaxFileSize(bucketId)-f.File().Size())/int64(fh.BucketSize) {
+		writeError(w, http.StatusBadRequest, env.NewError(InvalidFileSize, ""))
+		return
+	}
+
+	file, err := p.ExtendFile(id, additionalBuckets)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	responseFile(w, id, file.Name())
+}
@@ -1,6 +1,7 @@
 package module
 
 import (
+	"bktfile"
 	"encoding/json"
 	"fsea/env"
 	"fsea/pool"
@@ -41,12 +42,12 @@ func (m Mount) Action(ctx *gwf.Context) {
 		fullName := b.Path + "/" + f.Name
 		p := pool.GetPool()
 		if err = p.AddFile(bucketId, f.Id, fullName); err != nil {
-			writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+			writeMountError(w, err)
 			return
 		}
 		config.AddFileAndSave(bucketId, f)
 
-		m.response(w, pool.TransId(bucketId, f.Id), fullName)
+		responseFile(w, pool.TransId(bucketId, f.Id), fullName)
 
 	} else if depth == 4 {
 		p2, _ := ctx.Path(2)
@@ -60,8 +61,13 @@ func (m Mount) Action(ctx *gwf.Context) {
 			return
 		}
 
-		// max is 16GB.
-		if bucketSize*numberOfBuckets > 1<<34 {
+		if numberOfBuckets < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// 文件大小上限由config.bucket[].max_file_size指定，默认16G。用除法比较，避免乘法溢出
+		if int64(numberOfBuckets) > config.MaxFileSize(bucketId)/(int64(bucketSize)*4096) {
 			writeError(w, http.StatusBadRequest, env.NewError(InvalidFileSize, ""))
 			return
 		}
@@ -75,17 +81,31 @@ func (m Mount) Action(ctx *gwf.Context) {
 		fullName := b.Path + "/" + f.Name
 		bucketSize = bucketSize * 4096 // this is actual size
 		p := pool.GetPool()
-		err = p.MountFile(bucketId, f.Id, fullName, int32(bucketSize), int32(numberOfBuckets))
+		err = p.MountFile(bucketId, f.Id, fullName, int32(bucketSize), int64(numberOfBuckets))
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+			writeMountError(w, err)
 			return
 		}
 		config.AddFileAndSave(bucketId, f)
-		m.response(w, pool.TransId(bucketId, f.Id), fullName)
+		responseFile(w, pool.TransId(bucketId, f.Id), fullName)
+	}
+}
+
+// 挂载失败。文件被别的进程打开，或者文件身份和挂载的位置不符时返回409
+func writeMountError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *bktfile.LockError:
+		writeError(w, http.StatusConflict, env.NewError(FileLocked, err.Error()))
+		return
+	case *pool.IdentityError:
+		writeError(w, http.StatusConflict, env.NewError(FileMismatch, err.Error()))
+		return
 	}
+	writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
 }
 
-func (m *Mount) response(w http.ResponseWriter, id string, name string) {
+// 返回文件的id，大小和文件名
+func responseFile(w http.ResponseWriter, id string, name string) {
 	fi, err := os.Stat(name)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
@@ -0,0 +1,47 @@
+package module
+
+import (
+	"encoding/json"
+	"fsea/env"
+	"fsea/pool"
+	"gwf"
+	"net/http"
+	"strconv"
+)
+
+// 把已挂载的文件中用旧密钥加密的对象改用当前密钥重新加密
+// /rekey/[File ID]
+type Rekey struct {
+}
+
+func (r Rekey) Action(ctx *gwf.Context) {
+	w := ctx.Writer()
+	if ctx.Depth() != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, _ := ctx.Path(1)
+	p := pool.GetPool()
+	f := p.GetFile(id)
+	if f == nil {
+		writeError(w, http.StatusBadRequest, env.NewError(InvalidFileId, id))
+		return
+	}
+
+	count, err := p.Rekey(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	data, err := json.Marshal(map[string]string{
+		"id":      id,
+		"key":     strconv.FormatUint(uint64(f.File().KeyID()), 10),
+		"rekeyed": strconv.Itoa(count),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	w.Write(data)
+}
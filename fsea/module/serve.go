@@ -1,14 +1,25 @@
 package module
 
 import (
+	"bktfile"
+	"bufio"
 	"fmt"
 	"fsea/env"
 	"fsea/pool"
-	"io/ioutil"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// 自定义元数据的请求头和响应头前缀
+const metaHeaderPrefix = "X-Meta-"
+
+// 数据的有效期，单位秒。优先于Expires
+const expiresHeader = "X-Fsea-Expires"
+
 type Serve struct{}
 
 func (s Serve) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -18,6 +29,8 @@ func (s Serve) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.doGet(w, r)
 	} else if r.Method == "DELETE" {
 		s.doDelete(w, r)
+	} else if r.Method == "PATCH" {
+		s.doPatch(w, r)
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
 	}
@@ -25,33 +38,167 @@ func (s Serve) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s Serve) doGet(w http.ResponseWriter, r *http.Request) {
 	p := pool.GetPool()
-	if d, t, err := p.Read(r.URL.Path[1:]); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	dataId := r.URL.Path[1:]
+	meta, err := p.Meta(dataId)
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusInternalServerError), err)
 		return
-	} else {
-		w.Header().Add("Last-Modified", time.Unix(t, 0).Format(time.RFC1123))
-		w.Write(d)
 	}
+	// 压缩过的数据，客户端接受gzip时直接返回压缩后的数据，否则解压
+	rs, t, codec, err := p.OpenRaw(dataId)
+	if err == nil && codec != bktfile.CODEC_NONE {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if codec == bktfile.CODEC_GZIP && acceptsGzip(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			if meta.ContentType == "" {
+				meta.ContentType = "application/octet-stream"
+			}
+		} else {
+			rs, t, err = p.OpenReader(dataId)
+		}
+	}
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+	writeMeta(w.Header(), meta)
+	http.ServeContent(w, r, "", time.Unix(t, 0), rs)
+}
+
+// 请求头Accept-Encoding中是否接受gzip
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h["Accept-Encoding"] {
+		for _, coding := range strings.Split(v, ",") {
+			params := strings.Split(coding, ";")
+			if strings.TrimSpace(params[0]) != "gzip" {
+				continue
+			}
+			if len(params) > 1 {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params[1]), "q="), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
 }
 
+// 元数据写入响应头
+func writeMeta(h http.Header, meta *bktfile.Meta) {
+	if meta.ContentType != "" {
+		h.Set("Content-Type", meta.ContentType)
+	}
+	if meta.FileName != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": meta.FileName}))
+	}
+	for key, value := range meta.Headers {
+		h.Set(metaHeaderPrefix+key, value)
+	}
+	if meta.Expires != 0 {
+		h.Set("Expires", time.Unix(meta.Expires, 0).UTC().Format(http.TimeFormat))
+	}
+}
+
+// 请求头中的过期时间：X-Fsea-Expires是从现在开始的秒数，Expires是HTTP日期。没有时返回false
+func readExpires(h http.Header, now time.Time) (int64, bool, error) {
+	if v := h.Get(expiresHeader); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds <= 0 {
+			return 0, false, fmt.Errorf("invalid %s %q", expiresHeader, v)
+		}
+		return now.Unix() + seconds, true, nil
+	}
+	if v := h.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil || t.Unix() <= 0 {
+			return 0, false, fmt.Errorf("invalid Expires %q", v)
+		}
+		return t.Unix(), true, nil
+	}
+	return 0, false, nil
+}
+
+// 用请求头中带有的项修改元数据。Content-Type，Content-Disposition中的filename，
+// 以及X-Meta-开头的自定义项，自定义项的值为空时删除这一项
+func readMeta(h http.Header, meta *bktfile.Meta) {
+	if v, ok := h["Content-Type"]; ok {
+		meta.ContentType = v[0]
+	}
+	if v, ok := h["Content-Disposition"]; ok {
+		meta.FileName = ""
+		if _, params, err := mime.ParseMediaType(v[0]); err == nil {
+			meta.FileName = params["filename"]
+		}
+	}
+	for key, v := range h {
+		if !strings.HasPrefix(key, metaHeaderPrefix) || len(key) == len(metaHeaderPrefix) {
+			continue
+		}
+		key = key[len(metaHeaderPrefix):]
+		if v[0] == "" {
+			delete(meta.Headers, key)
+			continue
+		}
+		if meta.Headers == nil {
+			meta.Headers = make(map[string]string)
+		}
+		meta.Headers[key] = v[0]
+	}
+}
+
+// 默认放入回收站，带purge参数时直接回收
 func (s Serve) doDelete(w http.ResponseWriter, r *http.Request) {
 	p := pool.GetPool()
-	if err := p.Delete(r.URL.Path[1:]); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+	dataId := r.URL.Path[1:]
+	var err *env.Error
+	if purge, _ := strconv.ParseBool(r.URL.Query().Get("purge")); purge {
+		err = p.Destroy(dataId)
+	} else {
+		err = p.Delete(dataId)
+	}
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
+	}
+}
+
+// 数据已经被回收时返回410，已经过期时返回404，其他错误返回status
+func errorStatus(err *env.Error, status int) int {
+	switch err.Err {
+	case env.DataGone:
+		return http.StatusGone
+	case env.DataExpired:
+		return http.StatusNotFound
 	}
+	return status
 }
 
+// 数据按Content-Length流式写入，不支持没有声明长度的请求
 func (s Serve) doPut(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
-		var data []byte
-		data, err := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		if err != nil {
-			writeError(w, http.StatusBadRequest, env.NewError(UnspecificError, err.Error()))
+		defer r.Body.Close()
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		meta := &bktfile.Meta{}
+		readMeta(r.Header, meta)
+		expires, _, e := readExpires(r.Header, time.Now())
+		if e != nil {
+			writeError(w, http.StatusBadRequest, env.NewError(UnspecificError, e.Error()))
 			return
 		}
+		meta.Expires = expires
+		var body io.Reader = r.Body
+		if meta.ContentType == "" {
+			// 没有声明类型时按数据开头判断
+			br := bufio.NewReaderSize(r.Body, 512)
+			head, _ := br.Peek(512)
+			meta.ContentType = http.DetectContentType(head)
+			body = br
+		}
 		p := pool.GetPool()
-		id, err := p.Write(data)
+		id, err := p.WriteWithMeta(body, r.ContentLength, meta)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
 		} else {
@@ -59,3 +206,22 @@ func (s Serve) doPut(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// 只修改元数据，不重写数据。修改后的元数据不能超过写入时保留的大小，写入时带有过期时间的数据可以修改过期时间
+func (s Serve) doPatch(w http.ResponseWriter, r *http.Request) {
+	expires, ok, e := readExpires(r.Header, time.Now())
+	if e != nil {
+		writeError(w, http.StatusBadRequest, env.NewError(UnspecificError, e.Error()))
+		return
+	}
+	p := pool.GetPool()
+	err := p.UpdateMeta(r.URL.Path[1:], func(meta *bktfile.Meta) {
+		readMeta(r.Header, meta)
+		if ok {
+			meta.Expires = expires
+		}
+	})
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
+	}
+}
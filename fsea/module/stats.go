@@ -0,0 +1,47 @@
+package module
+
+import (
+	"encoding/json"
+	"fsea/env"
+	"fsea/pool"
+	"gwf"
+	"net/http"
+)
+
+// 文件的统计
+// /stats 所有挂载的文件，以及按桶大小和桶目录的汇总
+// /stats/[File ID] 一个文件
+type Stats struct {
+}
+
+func (s Stats) Action(ctx *gwf.Context) {
+	w := ctx.Writer()
+	p := pool.GetPool()
+
+	var v interface{}
+	var err error
+	switch ctx.Depth() {
+	case 1:
+		v, err = p.Stats()
+	case 2:
+		id, _ := ctx.Path(1)
+		if p.GetFile(id) == nil {
+			writeError(w, http.StatusBadRequest, env.NewError(InvalidFileId, id))
+			return
+		}
+		v, err = p.FileStats(id)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+		return
+	}
+	w.Write(data)
+}
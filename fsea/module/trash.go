@@ -0,0 +1,48 @@
+package module
+
+import (
+	"encoding/json"
+	"fsea/env"
+	"fsea/pool"
+	"gwf"
+	"net/http"
+)
+
+// 回收站管理
+// /trash/list 列出回收站中的数据id
+// /trash/restore/[Data ID] 恢复数据
+// /trash/purge/[Data ID] 彻底删除数据
+type Trash struct {
+}
+
+func (t Trash) Action(ctx *gwf.Context) {
+	w := ctx.Writer()
+	cmd, _ := ctx.Path(1)
+	dataId, _ := ctx.Path(2)
+	p := pool.GetPool()
+
+	switch {
+	case cmd == "list" && ctx.Depth() == 2:
+		ids, err := p.Trash()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+			return
+		}
+		data, err := json.Marshal(ids)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, env.NewError(UnspecificError, err.Error()))
+			return
+		}
+		w.Write(data)
+	case cmd == "restore" && ctx.Depth() == 3:
+		if err := p.Restore(dataId); err != nil {
+			writeError(w, errorStatus(err, http.StatusBadRequest), err)
+		}
+	case cmd == "purge" && ctx.Depth() == 3:
+		if err := p.Purge(dataId); err != nil {
+			writeError(w, errorStatus(err, http.StatusBadRequest), err)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,90 @@
+package pool
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// 压缩提交之后，过多久关闭并删除旧文件。正在读取旧文件的请求需要时间结束
+const closeDelay = time.Minute
+
+// 把文件压缩到新文件name中，新文件以newFid挂载，索引对应表写入remapName。
+// 复制期间旧文件仍然可以读取和删除，但不再写入新数据；复制完成后短暂停止旧文件的修改，同步复制期间的修改，
+// 保存对应表后调用commit保存配置。commit失败时放弃压缩，旧文件继续使用。
+// 提交之后旧文件被卸载，旧的数据id按对应表访问新文件，旧文件在closeDelay之后删除。
+func (p *Pool) CompactFile(bid string, fid string, newFid string, name string, remapName string, commit func() error) error {
+	id, newId := TransId(bid, fid), TransId(bid, newFid)
+	f := p.GetFile(id)
+	if f == nil {
+		return errors.New("no such file to compact")
+	}
+	if p.GetFile(newId) != nil {
+		return errors.New("file id already exist.")
+	}
+
+	f.lock.Lock()
+	if f.compacting || f.compacted {
+		f.lock.Unlock()
+		return errors.New("file is being compacted")
+	}
+	f.compacting = true
+	f.lock.Unlock()
+
+	p.files.RemoveFile(f)
+	c, err := f.file.CompactTo(name, 0666)
+	if err != nil {
+		p.abortCompact(f)
+		return err
+	}
+
+	if err = p.setupFile(c.File(), bid, newFid); err != nil {
+		os.Remove(name)
+		p.abortCompact(f)
+		return err
+	}
+
+	f.lock.Lock()
+	if err = c.CatchUp(); err == nil {
+		if err = c.Remap().Save(remapName); err == nil {
+			if err = commit(); err != nil {
+				os.Remove(remapName)
+			}
+		}
+	}
+	if err != nil {
+		f.lock.Unlock()
+		c.File().Close()
+		os.Remove(name)
+		os.Remove(name + ".journal")
+		p.abortCompact(f)
+		return err
+	}
+
+	file := &File{id: newId, file: c.File()}
+	p.lock.Lock()
+	delete(p.buckets, id)
+	p.buckets[newId] = file
+	p.remaps[id] = &remap{newId, c.Remap()}
+	p.lock.Unlock()
+	f.compacting, f.compacted = false, true
+	f.lock.Unlock()
+
+	p.files.RemoveFile(f)
+	p.files.AddFile(file)
+	time.AfterFunc(closeDelay, func() {
+		oldName := f.file.Name()
+		f.file.Close()
+		os.Remove(oldName)
+		os.Remove(oldName + ".journal")
+	})
+	return nil
+}
+
+// 压缩失败，文件重新加入可写列表
+func (p *Pool) abortCompact(f *File) {
+	f.lock.Lock()
+	f.compacting = false
+	f.lock.Unlock()
+	p.files.AddFile(f)
+}
@@ -0,0 +1,58 @@
+package pool
+
+import (
+	"bktfile"
+	"bytes"
+	"errors"
+	"fsea/env"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompactFile(t *testing.T) {
+	p, dir := newDedupPool(t)
+	defer closeDedupPool(p, dir)
+	conf := filepath.Join(dir, "fsea.conf")
+	if err := ioutil.WriteFile(conf, []byte("Id = \"node\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.CreateConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("compacted data")
+	id, err := p.WriteWithMeta(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存配置失败时放弃压缩，旧文件继续使用
+	name, remapName := filepath.Join(dir, "1_1.bkt"), filepath.Join(dir, "0_1.remap")
+	err = p.CompactFile("0", "0", "1", name, remapName, func() error { return errors.New("save failed") })
+	if err == nil {
+		t.Fatal("compaction should fail when the config is not saved")
+	}
+	if p.GetFile(TransId("0", "0")) == nil || p.GetFile(TransId("0", "1")) != nil {
+		t.Error("old file should stay mounted")
+	}
+	for _, n := range []string{name, remapName} {
+		if _, err := os.Stat(n); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed: %v", n, err)
+		}
+	}
+	if _, err := p.WriteWithMeta(bytes.NewReader(data), int64(len(data)), &bktfile.Meta{ContentType: "text/plain"}); err != nil {
+		t.Error("old file should be writable again", err)
+	}
+
+	if err := p.CompactFile("0", "0", "1", name, remapName, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetFile(TransId("0", "0")) != nil || p.GetFile(TransId("0", "1")) == nil {
+		t.Error("new file should replace the old one")
+	}
+	if d, _, err := p.Read(id); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("old id should be read from the new file: %q, %v", d, err)
+	}
+}
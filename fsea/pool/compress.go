@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"bktfile"
+	"bytes"
+	"fmt"
+	"fsea/env"
+	"io"
+	"io/ioutil"
+)
+
+// 按配置压缩length长度的数据，返回实际要写入的数据，长度和压缩方式。
+// 数据在内存中压缩，压缩后没有变小时写入原来的数据
+func compress(r io.Reader, length int64) (io.Reader, int64, bktfile.Codec, error) {
+	config := env.GetConfig()
+	if config == nil || config.Compress.Codec == env.CodecNone {
+		return r, length, bktfile.CODEC_NONE, nil
+	}
+	c := config.Compress
+	if length < c.Min || length > c.MaxSize() {
+		return r, length, bktfile.CODEC_NONE, nil
+	}
+
+	var codec bktfile.Codec
+	switch c.Codec {
+	case env.CodecGzip:
+		codec = bktfile.CODEC_GZIP
+	default:
+		return nil, 0, bktfile.CODEC_NONE, fmt.Errorf("unknown codec %q", c.Codec)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return nil, 0, bktfile.CODEC_NONE, err
+	}
+	if int64(len(data)) < length {
+		return nil, 0, bktfile.CODEC_NONE, io.ErrUnexpectedEOF
+	}
+	compressed, err := bktfile.Compress(codec, data)
+	if err != nil {
+		return nil, 0, bktfile.CODEC_NONE, err
+	}
+	if len(compressed) >= len(data) {
+		return bytes.NewReader(data), length, bktfile.CODEC_NONE, nil
+	}
+	return bytes.NewReader(compressed), int64(len(compressed)), codec, nil
+}
@@ -0,0 +1,265 @@
+package pool
+
+import (
+	"bktfile"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 去重：相同内容的数据只存放一份。索引记录内容的SHA-256到数据id的对应关系，以及数据id被引用的次数。
+// 写入之前先计算SHA-256，已经有内容和元数据都相同的数据时不写入，返回已有的数据id，引用次数加1；
+// 删除数据时引用次数减1，最后一个引用被删除时才真正删除数据。
+// 同一个数据id有不同的写法(大小写、前导0、不带代数)，按文件id和桶索引查找引用次数。
+// 带有过期时间的数据不去重。数据被删除之后就不在索引中了，从回收站恢复的数据是普通的数据。
+//
+// 索引文件是追加写入的文本文件，每行是 SHA-256 数据id 引用次数，后面的行覆盖前面的，引用次数为0表示删除。
+// 加载时重写成只有有效的行。
+type dedupIndex struct {
+	lock   sync.Mutex
+	name   string
+	file   *os.File
+	byHash map[string]*dedupEntry
+	byId   map[string]*dedupEntry // 键是dedupKey
+}
+
+type dedupEntry struct {
+	hash string
+	id   string
+	refs int
+}
+
+// 计算SHA-256之前读入内存的最大长度，更长的数据放在临时文件中
+const dedupMemMax = 16 << 20
+
+// 数据id规范化成"文件id:桶索引"，同时返回代数
+func dedupKey(dataId string) (string, uint32, bool) {
+	id, index, generation, err := parseDataId(dataId)
+	if err != nil {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%s:%x", id, index), generation, true
+}
+
+// 加载索引文件，文件不存在时创建
+func openDedupIndex(name string) (*dedupIndex, error) {
+	d := &dedupIndex{
+		name:   name,
+		byHash: make(map[string]*dedupEntry),
+		byId:   make(map[string]*dedupEntry),
+	}
+	if f, err := os.Open(name); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 {
+				continue
+			}
+			refs, err := strconv.Atoi(fields[2])
+			if err != nil {
+				continue
+			}
+			d.set(&dedupEntry{fields[0], fields[1], refs})
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// 重写索引文件，先写临时文件再改名
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range d.byHash {
+		fmt.Fprintf(w, "%s %s %d\n", e.hash, e.id, e.refs)
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	if d.file, err = os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// 更新内存中的索引，调用者已经加锁
+func (d *dedupIndex) set(e *dedupEntry) {
+	if old, ok := d.byHash[e.hash]; ok {
+		if key, _, ok := dedupKey(old.id); ok {
+			delete(d.byId, key)
+		}
+		delete(d.byHash, e.hash)
+	}
+	key, _, ok := dedupKey(e.id)
+	if e.refs > 0 && ok {
+		d.byHash[e.hash] = e
+		d.byId[key] = e
+	}
+}
+
+// 按数据id查找，dataId带有代数时必须和索引中的代数相同。调用者已经加锁
+func (d *dedupIndex) lookup(dataId string) (*dedupEntry, bool) {
+	key, generation, ok := dedupKey(dataId)
+	if !ok {
+		return nil, false
+	}
+	e, ok := d.byId[key]
+	if !ok {
+		return nil, false
+	}
+	if _, g, _ := dedupKey(e.id); generation != 0 && g != 0 && generation != g {
+		return nil, false
+	}
+	return e, true
+}
+
+// 更新索引并追加到索引文件，同步到磁盘之后才返回，断电后引用次数不会变少。调用者已经加锁
+func (d *dedupIndex) save(e *dedupEntry) error {
+	d.set(e)
+	if _, err := fmt.Fprintf(d.file, "%s %s %d\n", e.hash, e.id, e.refs); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// 读出length长度的数据，计算SHA-256，返回可以再次读取数据的Reader。
+// 不超过dedupMemMax的数据放在内存中，更长的放在临时文件中，用完之后调用done删除
+func readForDedup(r io.Reader, length int64) (io.Reader, string, func(), error) {
+	if length <= dedupMemMax {
+		data, err := ioutil.ReadAll(io.LimitReader(r, length))
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if int64(len(data)) < length {
+			return nil, "", nil, io.ErrUnexpectedEOF
+		}
+		sum := sha256.Sum256(data)
+		return bytes.NewReader(data), hex.EncodeToString(sum[:]), func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "fsea-dedup")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	done := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, length))
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		done()
+		return nil, "", nil, err
+	}
+	return tmp, hex.EncodeToString(h.Sum(nil)), done, nil
+}
+
+// 已经有内容为hash，元数据为meta的数据时引用次数加1，返回已有的数据id
+func (p *Pool) findDuplicate(hash string, meta *bktfile.Meta) (string, bool) {
+	d := p.dedup
+	defer d.lock.Unlock()
+	d.lock.Lock()
+
+	e, ok := d.byHash[hash]
+	if !ok {
+		return "", false
+	}
+	// 已有的数据被回收了，或者元数据不同，作为普通的数据写入
+	existing, err := p.Meta(e.id)
+	if err != nil || !sameMeta(existing, meta) {
+		return "", false
+	}
+	if err := d.save(&dedupEntry{hash, e.id, e.refs + 1}); err != nil {
+		log.Printf("failed to save dedup index %s.[%s]", d.name, err.Error())
+		return "", false
+	}
+	return e.id, true
+}
+
+// 记下新写入的数据id为id，内容为hash的数据。已有的相同内容的数据还在时不记录，作为普通的数据
+func (p *Pool) addDuplicate(id string, hash string) {
+	d := p.dedup
+	defer d.lock.Unlock()
+	d.lock.Lock()
+
+	if e, ok := d.byHash[hash]; ok {
+		if _, err := p.Meta(e.id); err == nil {
+			return
+		}
+	}
+	if err := d.save(&dedupEntry{hash, id, 1}); err != nil {
+		log.Printf("failed to save dedup index %s.[%s]", d.name, err.Error())
+	}
+}
+
+// 删除数据之前减少引用次数。还有其他引用时返回true，数据不用删除
+func (p *Pool) unref(dataId string) bool {
+	d := p.dedup
+	if d == nil {
+		return false
+	}
+	defer d.lock.Unlock()
+	d.lock.Lock()
+
+	e, ok := d.lookup(dataId)
+	if !ok {
+		return false
+	}
+	if err := d.save(&dedupEntry{e.hash, e.id, e.refs - 1}); err != nil {
+		log.Printf("failed to save dedup index %s.[%s]", d.name, err.Error())
+	}
+	return e.refs > 1
+}
+
+// 元数据是否相同，nil和空的元数据相同
+func sameMeta(a *bktfile.Meta, b *bktfile.Meta) bool {
+	if a == nil {
+		a = &bktfile.Meta{}
+	}
+	if b == nil {
+		b = &bktfile.Meta{}
+	}
+	if a.ContentType != b.ContentType || a.FileName != b.FileName || a.Expires != b.Expires ||
+		len(a.Headers) != len(b.Headers) {
+		return false
+	}
+	for key, value := range a.Headers {
+		if v, ok := b.Headers[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
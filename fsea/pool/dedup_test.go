@@ -0,0 +1,171 @@
+package pool
+
+import (
+	"bktfile"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 一个文件、开启去重的Pool
+func newDedupPool(t *testing.T) (*Pool, string) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := bktfile.CreateFile(filepath.Join(dir, "0_1.bkt"), 0666, 4096, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Pool{buckets: make(map[string]*File), remaps: make(map[string]*remap)}
+	if p.dedup, err = openDedupIndex(filepath.Join(dir, "dedup")); err != nil {
+		t.Fatal(err)
+	}
+	file := &File{id: TransId("0", "0"), file: f}
+	p.buckets[file.id] = file
+	p.files.AddFile(file)
+	return p, dir
+}
+
+func closeDedupPool(p *Pool, dir string) {
+	for _, f := range p.allFiles() {
+		f.file.Close()
+	}
+	p.dedup.file.Close()
+	os.RemoveAll(dir)
+}
+
+func TestDedup(t *testing.T) {
+	p, dir := newDedupPool(t)
+	defer closeDedupPool(p, dir)
+
+	data := []byte("the same content")
+	write := func(meta *bktfile.Meta) string {
+		id, err := p.WriteWithMeta(bytes.NewReader(data), int64(len(data)), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	read := func(id string) error {
+		_, _, err := p.Read(id)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	refs := func(id string) int {
+		if e, ok := p.dedup.lookup(id); ok {
+			return e.refs
+		}
+		return 0
+	}
+
+	first := write(nil)
+	if second := write(&bktfile.Meta{}); second != first {
+		t.Fatalf("same content and meta written as %s and %s", first, second)
+	}
+	if n := refs(first); n != 2 {
+		t.Fatalf("refs of %s: %d", first, n)
+	}
+	// 元数据不同时不去重，带有过期时间的数据不去重。重复的数据没有写入，下一个桶的代数没有变
+	if other := write(&bktfile.Meta{ContentType: "text/plain"}); other != "0:0:1.1" {
+		t.Errorf("data with different meta written as %s, want 0:0:1.1", other)
+	}
+	if other := write(&bktfile.Meta{Expires: 1 << 40}); other == first {
+		t.Error("data with expiry should not be deduplicated")
+	}
+	if empty := p.buckets["0:0"].file.FileHeader().NumberOfEmptyBuckets; empty != 16-3 {
+		t.Errorf("%d empty buckets, want %d", empty, 16-3)
+	}
+
+	// 数据id的其他写法同样只减少引用次数
+	write(nil)
+	for _, id := range []string{"0:0:00", "0:0:0.01"} {
+		if refs(id) != refs(first) {
+			t.Errorf("refs of %s: %d, refs of %s: %d", id, refs(id), first, refs(first))
+		}
+	}
+	if err := p.Delete("0:0:00"); err != nil {
+		t.Fatal(err)
+	}
+	if n := refs(first); n != 2 {
+		t.Errorf("refs of %s after deleting 0:0:00: %d", first, n)
+	}
+	if _, ok := p.dedup.lookup("0:0:0.2"); ok {
+		t.Error("id of another generation should not be found")
+	}
+
+	// 还有其他引用时删除只减少引用次数，最后一个引用删除时才放入回收站
+	if err := p.Delete(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(first); err != nil {
+		t.Fatal("shared data should be kept", err)
+	}
+	if err := p.Purge(first); err == nil {
+		t.Error("shared data not in trash should not be purged")
+	}
+	if err := p.Delete(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.dedup.lookup(first); ok {
+		t.Error("deleted data should be removed from the index")
+	}
+
+	// 从回收站恢复的数据是普通的数据，相同的内容重新写入
+	if err := p.Restore(first); err != nil {
+		t.Fatal(err)
+	}
+	if again := write(nil); again == first {
+		t.Error("restored data should not be in the index")
+	}
+	if err := p.Delete(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Purge(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(first); err == nil {
+		t.Error("purged data should not be read")
+	}
+
+	// 重新加载索引，引用次数不变
+	third := write(nil)
+	if n := refs(third); n != 2 {
+		t.Fatalf("refs of %s: %d", third, n)
+	}
+	p.dedup.file.Close()
+	d, err := openDedupIndex(p.dedup.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.dedup = d
+	if n := refs(third); n != 2 || len(d.byId) != 1 {
+		t.Errorf("reloaded index: refs %d, %d entries", n, len(d.byId))
+	}
+}
+
+func TestSameMeta(t *testing.T) {
+	cases := []struct {
+		a, b *bktfile.Meta
+		same bool
+	}{
+		{nil, nil, true},
+		{nil, &bktfile.Meta{}, true},
+		{&bktfile.Meta{ContentType: "a"}, &bktfile.Meta{ContentType: "a"}, true},
+		{&bktfile.Meta{ContentType: "a"}, &bktfile.Meta{ContentType: "b"}, false},
+		{&bktfile.Meta{FileName: "a"}, nil, false},
+		{&bktfile.Meta{Headers: map[string]string{"k": "v"}}, &bktfile.Meta{Headers: map[string]string{"k": "v"}}, true},
+		{&bktfile.Meta{Headers: map[string]string{"k": "v"}}, &bktfile.Meta{Headers: map[string]string{"k": "w"}}, false},
+		{&bktfile.Meta{Headers: map[string]string{"k": "v"}}, &bktfile.Meta{}, false},
+	}
+	for i, c := range cases {
+		if same := sameMeta(c.a, c.b); same != c.same {
+			t.Errorf("case %d: sameMeta = %v, want %v", i, same, c.same)
+		}
+	}
+}
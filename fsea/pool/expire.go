@@ -0,0 +1,53 @@
+package pool
+
+import (
+	"log"
+	"time"
+)
+
+// 回收在now时已经过期的数据，rate是每秒最多回收的个数，0表示不限制。返回回收的个数
+func (p *Pool) ReapExpired(now time.Time, rate int) int {
+	var throttle <-chan time.Time
+	// rate超过每秒10亿时间隔为0，按不限制处理
+	if rate > 0 && time.Second/time.Duration(rate) > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	count := 0
+	for _, f := range p.allFiles() {
+		indexes, generations, err := f.file.Expired(now.Unix())
+		if err != nil {
+			log.Printf("(%s)failed to find expired data: %s\n", f.id, err.Error())
+			continue
+		}
+		for i, index := range indexes {
+			if throttle != nil {
+				<-throttle
+			}
+			f.lock.RLock()
+			if f.compacted {
+				f.lock.RUnlock()
+				break
+			}
+			// 扫描之后桶可能已经被回收或者重新使用，过期时间也可能被修改，回收时重新检查
+			err := p.free(f, func() error { return f.file.EmptyExpired(index, generations[i], now.Unix()) })
+			f.lock.RUnlock()
+			if err == nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// 定时回收过期的数据，不会返回
+func (p *Pool) Reap(interval time.Duration, rate int) {
+	for {
+		time.Sleep(interval)
+		if n := p.ReapExpired(time.Now(), rate); n > 0 {
+			log.Printf("%d expired buckets reaped\n", n)
+		}
+	}
+}
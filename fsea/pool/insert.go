@@ -2,8 +2,10 @@ package pool
 
 import (
 	"bktfile"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"sort"
 	"sync"
 )
@@ -11,6 +13,12 @@ import (
 type File struct {
 	id   string
 	file *bktfile.File
+
+	// 修改文件时加读锁，压缩提交时加写锁
+	lock sync.RWMutex
+	// 正在压缩，以及已经压缩到新文件，不能再修改
+	compacting bool
+	compacted  bool
 }
 
 func (f *File) Weight() float64 {
@@ -34,32 +42,53 @@ func (w ByWeight) Len() int           { return len(w) }
 func (w ByWeight) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
 func (w ByWeight) Less(i, j int) bool { return w[i].Weight() > w[j].Weight() } // 倒序排列
 
-func (f *File) genId(index int32) string {
-	return fmt.Sprintf("%s:%x", f.id, index)
+func (f *File) File() *bktfile.File {
+	return f.file
+}
+
+// id规则：[bid:fid:index.generation]，没有代数时为[bid:fid:index]
+func (f *File) genId(index int64, generation uint32) string {
+	if generation == 0 {
+		return fmt.Sprintf("%s:%x", f.id, index)
+	}
+	return fmt.Sprintf("%s:%x.%x", f.id, index, generation)
 }
 
 func (fs *Files) Sort() {
 	sort.Sort(ByWeight(fs.files))
 }
 
-func (fs *Files) Write(data []byte) (string, error) {
-	f := fs.files[0]
-	index, err := f.file.Write(data)
+// 挑选一个空桶足够存放length长度数据的文件，按权重顺序挑选
+func (fs *Files) pick(length int64) *File {
+	for _, f := range fs.files {
+		n := f.file.BucketsFor(length)
+		if n > 0 && n <= f.file.FileHeader().NumberOfEmptyBuckets {
+			return f
+		}
+	}
+	return nil
+}
 
-	// err的情况下也可能引起文件满
+// 写入之后重新排序，写满的文件从列表中去掉
+func (fs *Files) update(f *File) {
 	if f.file.IsFull() {
-		fs.files = fs.files[1:]
+		for i, file := range fs.files {
+			if file == f {
+				fs.files = append(fs.files[:i], fs.files[i+1:]...)
+				break
+			}
+		}
 	} else {
 		fs.Sort()
 	}
-
-	if err != nil {
-		return "", err
-	}
-	return f.genId(index), nil
 }
 
 func (fs *Files) AppendFile(f *File) {
+	for _, file := range fs.files {
+		if file == f {
+			return
+		}
+	}
 	fs.files = append(fs.files, f)
 	fs.Sort()
 }
@@ -104,21 +133,110 @@ func (s *FileSet) insert(fs *Files, i int) {
 }
 
 func (s *FileSet) Write(data []byte) (string, error) {
+	return s.WriteFrom(bytes.NewReader(data), int64(len(data)))
+}
+
+// 从r中读取length长度的数据写入。写入数据时不持有FileSet的锁。
+func (s *FileSet) WriteFrom(r io.Reader, length int64) (string, error) {
+	return s.WriteWithMeta(r, length, nil)
+}
+
+// 和WriteFrom一样写入数据，同时写入元数据。按配置先压缩数据，再按压缩后的长度挑选文件。
+// 元数据和压缩方式占用头桶的空间，挑选文件时算在数据长度里
+func (s *FileSet) WriteWithMeta(r io.Reader, length int64, meta *bktfile.Meta) (string, error) {
+	r, stored, codec, err := compress(r, length)
+	if err != nil {
+		return "", err
+	}
+
+	// 挑选文件之后到取出空桶之前不持有锁，文件可能被别的写入者写满。这时数据还没有读取，重新挑选文件
+	for retry := 0; ; retry++ {
+		f, err := s.pick(stored + int64(bktfile.HeadSize(meta, codec)))
+		if err != nil {
+			return "", err
+		}
+		f.lock.RLock()
+		if f.compacted {
+			f.lock.RUnlock()
+			s.RemoveFile(f)
+			continue
+		}
+
+		index, generation, err := f.file.WriteCompressed(r, stored, meta, codec, length)
+		f.lock.RUnlock()
+
+		// err的情况下也可能引起文件满
+		s.update(f)
+
+		if (err == bktfile.ErrFull || err == bktfile.ErrNoSpace) && retry < maxPickRetries {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return f.genId(index, generation), nil
+	}
+}
+
+// 挑选的文件被写满时最多重新挑选的次数
+const maxPickRetries = 8
+
+// 根据数据大小挑选一个文件。没有合适的桶大小时，用最大的桶链起来存放
+func (s *FileSet) pick(length int64) (*File, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
 	count := len(s.fileset)
 	if count == 0 {
-		return "", errors.New("No valid bucket files.")
+		return nil, errors.New("No valid bucket files.")
+	}
+
+	i := sort.Search(count, func(i int) bool { return int64(s.fileset[i].size) > length })
+	if i == count {
+		i = count - 1
+	}
+	if f := s.fileset[i].pick(length); f != nil {
+		return f, nil
 	}
+	return nil, errors.New("Data too large")
+}
+
+func (s *FileSet) update(f *File) {
+	bucketSize := f.file.FileHeader().BucketSize
 
 	defer s.lock.Unlock()
 	s.lock.Lock()
-	size := int32(len(data))
-	i := sort.Search(count, func(i int) bool { return s.fileset[i].size > size })
-	if i < count {
-		id, err := s.fileset[i].Write(data)
-		if s.fileset[i].IsFull() { // remove full item from list
-			s.fileset = append(s.fileset[:i], s.fileset[i+1:]...)
+
+	for i, fs := range s.fileset {
+		if fs.size == bucketSize {
+			fs.update(f)
+			if fs.IsFull() { // remove full item from list
+				s.fileset = append(s.fileset[:i], s.fileset[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// 从可写列表中去掉文件
+func (s *FileSet) RemoveFile(f *File) {
+	bucketSize := f.file.FileHeader().BucketSize
+
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	for i, fs := range s.fileset {
+		if fs.size == bucketSize {
+			for j, file := range fs.files {
+				if file == f {
+					fs.files = append(fs.files[:j], fs.files[j+1:]...)
+					break
+				}
+			}
+			if fs.IsFull() {
+				s.fileset = append(s.fileset[:i], s.fileset[i+1:]...)
+			}
+			return
 		}
-		return id, err
 	}
-	return "", errors.New("Data too large")
 }
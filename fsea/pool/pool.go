@@ -2,14 +2,17 @@ package pool
 
 import (
 	"bktfile"
+	"bytes"
 	"errors"
 	"fmt"
 	"fsea/env"
+	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 func TransId(bid string, fid string) string {
@@ -17,37 +20,86 @@ func TransId(bid string, fid string) string {
 }
 
 type Pool struct {
-	// 针对buckets的lock
+	// 针对buckets和remaps的lock
 	lock    sync.RWMutex
 	buckets map[string]*File
 	files   FileSet
+	// 压缩掉的文件id到新文件的对应关系
+	remaps map[string]*remap
+	// 加密用的密钥，没有配置密钥文件时为nil
+	keys *bktfile.Keyring
+	// 去重索引，没有配置时为nil
+	dedup *dedupIndex
+}
+
+// 文件压缩后的桶索引对应关系
+type remap struct {
+	to    string
+	table *bktfile.Remap
 }
 
 var pool *Pool
 
+// 按配置创建并加载Pool。配置的密钥文件或者去重索引读不出来时返回错误
+func CreatePool() (*Pool, error) {
+	p := &Pool{}
+	if err := p.Init(); err != nil {
+		return nil, err
+	}
+	pool = p
+	return pool, nil
+}
+
 func GetPool() *Pool {
 	if pool == nil {
-		pool = &Pool{}
-		pool.Init()
+		if _, err := CreatePool(); err != nil {
+			log.Fatal(err)
+		}
 	}
 	return pool
 }
 
 // 初始化，不需要加锁
-func (p *Pool) Init() {
+func (p *Pool) Init() error {
 	p.buckets = make(map[string]*File)
+	p.remaps = make(map[string]*remap)
 	config := env.GetConfig()
+	if config.Keyfile != "" {
+		keys, err := bktfile.ReadKeyring(config.Keyfile)
+		if err != nil {
+			return fmt.Errorf("failed to load keyfile %s.[%s]", config.Keyfile, err.Error())
+		}
+		p.keys = keys
+	}
+	if config.Dedup != "" {
+		// 索引读不出来时不能关闭去重，否则删除一个引用会删除所有引用共用的数据
+		dedup, err := openDedupIndex(config.Dedup)
+		if err != nil {
+			return fmt.Errorf("failed to load dedup index %s.[%s]", config.Dedup, err.Error())
+		}
+		p.dedup = dedup
+	}
 	for _, bucket := range config.Bucket {
+		for _, r := range bucket.Remap {
+			name := bucket.Path + string(os.PathSeparator) + r.Name
+			table, err := bktfile.ReadRemap(name)
+			if err != nil {
+				log.Printf("failed to load remap %s.[%s]", name, err.Error())
+				continue
+			}
+			p.remaps[TransId(bucket.Id, r.Id)] = &remap{TransId(bucket.Id, r.To), table}
+		}
 		for _, file := range bucket.File {
 			name := bucket.Path + string(os.PathSeparator) + file.Name
 			id := TransId(bucket.Id, file.Id)
-			if err := p.loadFile(id, name); err == nil {
+			if err := p.loadFile(bucket.Id, file.Id, name); err == nil {
 				log.Printf("(%s)loaded: %s\n", id, name)
 			} else {
 				log.Println(err)
 			}
 		}
 	}
+	return nil
 }
 
 // id规则：[bid:fid]
@@ -61,13 +113,157 @@ func (p *Pool) GetFile(id string) *File {
 	return nil
 }
 
-func (p *Pool) loadFile(id string, name string) error {
+// 按配置的策略在挂载前检查文件。文件有日志时先按日志恢复
+func checkFile(name string) error {
+	if err := bktfile.Recover(name); err != nil {
+		return err
+	}
+
+	var report *bktfile.Report
+	var err error
+	policy := env.GetConfig().Fsck
+	switch policy {
+	case env.FsckNone:
+		return nil
+	case env.FsckWarn, env.FsckRefuse:
+		report, err = bktfile.Check(name)
+	case env.FsckRepair:
+		report, err = bktfile.Repair(name)
+	default:
+		return fmt.Errorf("unknown fsck policy %q", policy)
+	}
+	if err != nil {
+		return err
+	}
+	if report.OK() {
+		return nil
+	}
+
+	log.Println(report)
+	for _, problem := range report.Problems {
+		log.Printf("%s[%d]: %s\n", name, problem.Index, problem.Message)
+	}
+	if policy == env.FsckRefuse {
+		return fmt.Errorf("%s failed the check with %d problems", name, len(report.Problems))
+	}
+	return nil
+}
+
+// 文件身份和挂载的位置不符
+type IdentityError struct {
+	Name     string
+	Identity bktfile.Identity
+	Owner    string
+	Bid      string
+	Fid      string
+}
+
+func (e *IdentityError) Error() string {
+	return fmt.Sprintf("%s was created as %s by %q, mounting as %s by %q", e.Name,
+		TransId(e.Identity.Bucket, e.Identity.File), e.Identity.Owner, TransId(e.Bid, e.Fid), e.Owner)
+}
+
+// 检查文件身份。新文件和没有身份的旧文件记下身份；和挂载的位置不符时按配置记录日志、拒绝挂载或者按新的位置重写。
+// 默认只记录日志，保留身份作为文件来源的证据，重建配置时也能发现复制来的文件
+func checkIdentity(f *bktfile.File, bid string, fid string) error {
+	config := env.GetConfig()
+	id := f.Identity()
+	if id.IsZero() {
+		id, err := bktfile.NewIdentity(config.Id, bid, fid)
+		if err != nil {
+			return err
+		}
+		if err := f.SetIdentity(id); err != nil {
+			log.Printf("failed to set identity of %s.[%s]", f.Name(), err.Error())
+		}
+		return nil
+	}
+	if id.Owner == config.Id && id.Bucket == bid && id.File == fid {
+		return nil
+	}
+
+	err := &IdentityError{f.Name(), id, config.Id, bid, fid}
+	switch config.Identity {
+	case env.IdentityWarn:
+		log.Println(err)
+		return nil
+	case env.IdentityRefuse:
+		return err
+	case env.IdentityRewrite:
+	default:
+		return fmt.Errorf("unknown identity policy %q", config.Identity)
+	}
+	log.Println(err)
+	id.Owner, id.Bucket, id.File = config.Id, bid, fid
+	if err := f.SetIdentity(id); err != nil {
+		log.Printf("failed to set identity of %s.[%s]", f.Name(), err.Error())
+	}
+	return nil
+}
+
+// 按配置检查文件身份，给文件启用日志，设置桶目录的同步方式和加密用的密钥
+func (p *Pool) setupFile(f *bktfile.File, bid string, fid string) error {
+	config := env.GetConfig()
+	if recovery := f.Recovery(); recovery != "" {
+		log.Printf("%s: %s", f.Name(), recovery)
+	}
+	if err := checkIdentity(f, bid, fid); err != nil {
+		f.Close()
+		return err
+	}
+	if p.keys != nil {
+		// 新写入的数据使用当前密钥。设置不了密钥(例如不支持加密的旧版本文件)时不能挂载，否则数据会明文写入
+		f.SetKeyring(p.keys)
+		if f.KeyID() != p.keys.Current() {
+			if err := f.SetKey(p.keys.Current()); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to set key of %s.[%s]", f.Name(), err.Error())
+			}
+		}
+	}
+	if bucket := config.GetBucket(bid); bucket != nil {
+		interval := time.Duration(bucket.SyncInterval) * time.Millisecond
+		switch bucket.Sync {
+		case env.SyncNone:
+		case env.SyncAlways:
+			f.SetSync(bktfile.SYNC_ALWAYS, interval)
+		case env.SyncGroup:
+			f.SetSync(bktfile.SYNC_GROUP, interval)
+		default:
+			f.Close()
+			return fmt.Errorf("unknown sync mode %q", bucket.Sync)
+		}
+		if bucket.PunchHoles {
+			if err := f.SetPunchHoles(true); err != nil {
+				log.Printf("failed to punch holes in %s.[%s]", f.Name(), err.Error())
+			}
+		}
+	}
+
+	if !config.Journal {
+		return nil
+	}
+	if err := f.EnableJournal(); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+func (p *Pool) loadFile(bid string, fid string, name string) error {
+	if err := checkFile(name); err != nil {
+		return err
+	}
 	f, err := bktfile.OpenFile(name, bktfile.OF_RDWR)
+	if err == nil {
+		err = p.setupFile(f, bid, fid)
+	}
 	if err != nil {
 		log.Printf("failed to load file %s.[%s]", name, err.Error())
 		return err
 	}
-	file := &File{id, f}
+	id := TransId(bid, fid)
+	file := &File{id: id, file: f}
 	p.buckets[id] = file
 	p.files.AddFile(file)
 	return nil
@@ -77,13 +273,19 @@ func (p *Pool) ReloadFile(bid string, fid string) error {
 	id := TransId(bid, fid)
 	f := p.GetFile(id)
 	if f != nil {
-		return f.file.Reopen(bktfile.OF_RDWR)
+		if err := f.file.Reopen(bktfile.OF_RDWR); err != nil {
+			return err
+		}
+		if recovery := f.file.Recovery(); recovery != "" {
+			log.Printf("%s: %s", f.file.Name(), recovery)
+		}
+		return nil
 	} else {
 		return errors.New("no such file to reload")
 	}
 }
 
-func (p *Pool) MountFile(bid string, fid string, name string, bucketSize int32, numberOfBuckets int32) error {
+func (p *Pool) MountFile(bid string, fid string, name string, bucketSize int32, numberOfBuckets int64) error {
 	id := TransId(bid, fid)
 	if p.GetFile(id) != nil {
 		return errors.New("file id already exist.")
@@ -93,8 +295,18 @@ func (p *Pool) MountFile(bid string, fid string, name string, bucketSize int32,
 	if err != nil {
 		return err
 	}
+	if bucket := env.GetConfig().GetBucket(bid); bucket != nil && bucket.Preallocate {
+		if err := f.Preallocate(); err != nil {
+			f.Close()
+			os.Remove(name)
+			return err
+		}
+	}
+	if err := p.setupFile(f, bid, fid); err != nil {
+		return err
+	}
 
-	file := &File{id, f}
+	file := &File{id: id, file: f}
 	p.lock.Lock()
 	p.buckets[id] = file
 	p.lock.Unlock()
@@ -109,11 +321,17 @@ func (p *Pool) AddFile(bid string, fid string, name string) error {
 		return errors.New("file id already exist.")
 	}
 
+	if err := checkFile(name); err != nil {
+		return err
+	}
 	f, err := bktfile.OpenFile(name, bktfile.OF_RDWR)
 	if err != nil {
 		return err
 	}
-	file := &File{id, f}
+	if err := p.setupFile(f, bid, fid); err != nil {
+		return err
+	}
+	file := &File{id: id, file: f}
 
 	p.lock.Lock()
 	p.buckets[id] = file
@@ -123,52 +341,337 @@ func (p *Pool) AddFile(bid string, fid string, name string) error {
 	return nil
 }
 
+// 给文件增加空桶，文件原来写满了的话重新加入可写列表
+func (p *Pool) ExtendFile(id string, additionalBuckets int64) (*bktfile.File, error) {
+	f := p.GetFile(id)
+	if f == nil {
+		return nil, errors.New("no such file to extend")
+	}
+	defer f.lock.RUnlock()
+	f.lock.RLock()
+	if f.compacted {
+		return nil, errors.New("file is compacted")
+	}
+	if err := p.free(f, func() error { return f.file.Extend(additionalBuckets) }); err != nil {
+		return nil, err
+	}
+	return f.file, nil
+}
+
+// 把文件中用旧密钥加密的对象改用当前密钥重新加密，返回改写的对象个数
+func (p *Pool) Rekey(id string) (int, error) {
+	if p.keys == nil {
+		return 0, errors.New("no keyfile configured")
+	}
+	f := p.GetFile(id)
+	if f == nil {
+		return 0, errors.New("no such file to rekey")
+	}
+	defer f.lock.RUnlock()
+	f.lock.RLock()
+	if f.compacted {
+		return 0, errors.New("file is compacted")
+	}
+	if f.file.KeyID() != p.keys.Current() {
+		if err := f.file.SetKey(p.keys.Current()); err != nil {
+			return 0, err
+		}
+	}
+	return f.file.RekeyAll()
+}
+
 func (p *Pool) Write(data []byte) (string, error) {
-	return p.files.Write(data)
+	if p.dedup == nil {
+		return p.files.Write(data)
+	}
+	return p.WriteWithMeta(bytes.NewReader(data), int64(len(data)), nil)
 }
 
-func (p *Pool) getFileEnv(dataId string) (*File, int32, *env.Error) {
+func (p *Pool) WriteFrom(r io.Reader, length int64) (string, error) {
+	if p.dedup == nil {
+		return p.files.WriteFrom(r, length)
+	}
+	return p.WriteWithMeta(r, length, nil)
+}
+
+// 写入数据。开启去重时，已经有相同的数据则返回已有的数据id
+func (p *Pool) WriteWithMeta(r io.Reader, length int64, meta *bktfile.Meta) (string, error) {
+	if p.dedup == nil || (meta != nil && meta.Expires != 0) {
+		return p.files.WriteWithMeta(r, length, meta)
+	}
+	// 先计算SHA-256，已经有相同的数据时不用写入
+	data, hash, done, err := readForDedup(r, length)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	if id, ok := p.findDuplicate(hash, meta); ok {
+		return id, nil
+	}
+	id, err := p.files.WriteWithMeta(data, length, meta)
+	if err != nil {
+		return "", err
+	}
+	p.addDuplicate(id, hash)
+	return id, nil
+}
+
+// 解析数据id，返回所在的文件，桶索引和代数。没有代数的旧id代数为0
+func (p *Pool) getFileEnv(dataId string) (*File, int64, uint32, *env.Error) {
+	id, index, generation, err := parseDataId(dataId)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	if f := p.GetFile(id); f != nil {
+		return f, index, generation, nil
+	}
+	return p.remapped(id, index, generation)
+}
+
+// 把数据id分成文件id，桶索引和代数
+func parseDataId(dataId string) (string, int64, uint32, *env.Error) {
 	sep := strings.LastIndex(dataId, ":")
 	if sep == -1 {
-		return nil, -1, env.NewError(env.InvalidDataId, dataId)
+		return "", -1, 0, env.NewError(env.InvalidDataId, dataId)
 	}
 	id := dataId[:sep]
-	index, err := strconv.ParseInt(dataId[sep+1:], 16, 64)
+	ref := dataId[sep+1:]
+	generation := uint64(0)
+	if dot := strings.Index(ref, "."); dot != -1 {
+		var err error
+		if generation, err = strconv.ParseUint(ref[dot+1:], 16, 32); err != nil {
+			return "", -1, 0, env.NewError(env.InvalidDataId, err.Error())
+		}
+		ref = ref[:dot]
+	}
+	index, err := strconv.ParseInt(ref, 16, 64)
 	if err != nil {
-		return nil, -1, env.NewError(env.InvalidDataId, err.Error())
+		return "", -1, 0, env.NewError(env.InvalidDataId, err.Error())
 	}
-	f := p.GetFile(id)
-	if f == nil {
-		return nil, -1, env.NewError(env.InvalidFileId, id)
+	return id, index, uint32(generation), nil
+}
+
+// 按压缩时记录的对应关系，找到压缩掉的文件中的桶现在所在的文件，索引和代数。
+// 文件可能被压缩了多次，依次查找。压缩时已经不存在的数据返回DataGone
+func (p *Pool) remapped(id string, index int64, generation uint32) (*File, int64, uint32, *env.Error) {
+	defer p.lock.RUnlock()
+	p.lock.RLock()
+
+	r, ok := p.remaps[id]
+	if !ok {
+		return nil, -1, 0, env.NewError(env.InvalidFileId, id)
+	}
+	for i := 0; i < len(p.remaps); i++ {
+		if index, generation, ok = r.table.LookupObject(index, generation); !ok {
+			return nil, -1, 0, env.NewError(env.DataGone, id)
+		}
+		if f, ok := p.buckets[r.to]; ok {
+			return f, index, generation, nil
+		}
+		if r, ok = p.remaps[r.to]; !ok {
+			break
+		}
+	}
+	return nil, -1, 0, env.NewError(env.InvalidDataId, id)
+}
+
+// 把桶文件的错误转换成返回给客户端的错误
+func dataError(dataId string, err error) *env.Error {
+	if err == bktfile.ErrGeneration {
+		return env.NewError(env.DataGone, dataId)
+	}
+	if err == bktfile.ErrExpired {
+		return env.NewError(env.DataExpired, dataId)
 	}
-	return f, int32(index), nil
+	if _, ok := err.(*bktfile.CorruptionError); ok {
+		log.Println(err)
+		return env.NewError(env.DataCorrupted, dataId)
+	}
+	return env.NewError(env.UnspecificError, err.Error())
 }
 
 func (p *Pool) Read(dataId string) ([]byte, int64, *env.Error) {
-	f, index, err := p.getFileEnv(dataId)
+	f, index, generation, err := p.getFileEnv(dataId)
 	if err != nil {
 		return nil, -1, err
 	}
-	d, t, e := f.file.Read(index)
+	d, t, e := f.file.ReadObject(index, generation)
 	if e != nil {
-		return nil, -1, env.NewError(env.UnspecificError, e.Error())
+		return nil, -1, dataError(dataId, e)
 	}
 	return d, t, nil
 }
 
-func (p *Pool) Delete(dataId string) *env.Error {
-	f, index, err := p.getFileEnv(dataId)
+// 打开数据进行流式读取，同时返回写入时间
+func (p *Pool) OpenReader(dataId string) (io.ReadSeeker, int64, *env.Error) {
+	f, index, generation, err := p.getFileEnv(dataId)
 	if err != nil {
-		return err
+		return nil, -1, err
+	}
+	r, t, e := f.file.OpenObject(index, generation)
+	if e != nil {
+		return nil, -1, dataError(dataId, e)
+	}
+	return r, t, nil
+}
+
+// 打开压缩后的数据，同时返回写入时间和压缩方式
+func (p *Pool) OpenRaw(dataId string) (io.ReadSeeker, int64, bktfile.Codec, *env.Error) {
+	f, index, generation, err := p.getFileEnv(dataId)
+	if err != nil {
+		return nil, -1, bktfile.CODEC_NONE, err
+	}
+	r, t, codec, e := f.file.OpenRaw(index, generation)
+	if e != nil {
+		return nil, -1, bktfile.CODEC_NONE, dataError(dataId, e)
+	}
+	return r, t, codec, nil
+}
+
+// 读取数据的元数据
+func (p *Pool) Meta(dataId string) (*bktfile.Meta, *env.Error) {
+	f, index, generation, err := p.getFileEnv(dataId)
+	if err != nil {
+		return nil, err
+	}
+	meta, e := f.file.ObjectMeta(index, generation)
+	if e != nil {
+		return nil, dataError(dataId, e)
+	}
+	return meta, nil
+}
+
+// 修改数据的元数据，不改动数据
+func (p *Pool) UpdateMeta(dataId string, update func(meta *bktfile.Meta)) *env.Error {
+	return p.modify(dataId, func(f *File, index int64, generation uint32) error {
+		return f.file.UpdateMeta(index, generation, update)
+	})
+}
+
+// 修改数据所在的文件。文件正好被压缩了的话，按新的文件重新查找
+func (p *Pool) modify(dataId string, fn func(f *File, index int64, generation uint32) error) *env.Error {
+	for {
+		f, index, generation, err := p.getFileEnv(dataId)
+		if err != nil {
+			return err
+		}
+		f.lock.RLock()
+		if f.compacted {
+			f.lock.RUnlock()
+			continue
+		}
+		e := fn(f, index, generation)
+		f.lock.RUnlock()
+		if e != nil {
+			return dataError(dataId, e)
+		}
+		return nil
+	}
+}
+
+// 将数据放入回收站。去重的数据还有其他引用时只减少引用次数
+func (p *Pool) Delete(dataId string) *env.Error {
+	if p.unref(dataId) {
+		return nil
+	}
+	return p.modify(dataId, func(f *File, index int64, generation uint32) error {
+		return f.file.DeleteObject(index, generation)
+	})
+}
+
+// 从回收站中恢复数据
+func (p *Pool) Restore(dataId string) *env.Error {
+	return p.modify(dataId, func(f *File, index int64, generation uint32) error {
+		return f.file.RestoreObject(index, generation)
+	})
+}
+
+// 彻底回收回收站中的数据，不在回收站中的数据不回收
+func (p *Pool) Purge(dataId string) *env.Error {
+	return p.modify(dataId, func(f *File, index int64, generation uint32) error {
+		return p.free(f, func() error { return f.file.PurgeObject(index, generation) })
+	})
+}
+
+// 直接回收数据所在的桶，不经过回收站。去重的数据还有其他引用时只减少引用次数
+func (p *Pool) Destroy(dataId string) *env.Error {
+	if p.unref(dataId) {
+		return nil
 	}
+	return p.modify(dataId, func(f *File, index int64, generation uint32) error {
+		return p.free(f, func() error { return f.file.EmptyObject(index, generation) })
+	})
+}
+
+// 执行回收桶或者增加空桶的操作。文件原来是满的，操作后有了空桶，则重新加入可写列表
+func (p *Pool) free(f *File, fn func() error) error {
 	full := f.file.IsFull()
 	defer func() {
 		if full && !f.file.IsFull() {
 			p.files.AddFile(f)
 		}
 	}()
-	if e := f.file.Empty(index); e != nil {
-		return env.NewError(env.UnspecificError, e.Error())
+	return fn()
+}
+
+func (p *Pool) allFiles() []*File {
+	defer p.lock.RUnlock()
+	p.lock.RLock()
+
+	files := make([]*File, 0, len(p.buckets))
+	for _, f := range p.buckets {
+		files = append(files, f)
+	}
+	return files
+}
+
+// 回收站中所有数据的id
+func (p *Pool) Trash() ([]string, error) {
+	ids := []string{}
+	for _, f := range p.allFiles() {
+		indexes, err := f.file.Deleted()
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range indexes {
+			generation, err := f.file.Generation(index)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, f.genId(index, generation))
+		}
+	}
+	return ids, nil
+}
+
+// 彻底回收在before之前放入回收站的数据
+func (p *Pool) PurgeDeleted(before time.Time) int {
+	count := 0
+	for _, f := range p.allFiles() {
+		f.lock.RLock()
+		if f.compacted {
+			f.lock.RUnlock()
+			continue
+		}
+		p.free(f, func() error {
+			n, err := f.file.PurgeDeleted(before.Unix())
+			if err != nil {
+				log.Printf("(%s)failed to purge trash: %s\n", f.id, err.Error())
+			}
+			count += n
+			return err
+		})
+		f.lock.RUnlock()
+	}
+	return count
+}
+
+// 定时清理回收站中超过保留时间的数据，不会返回
+func (p *Pool) Sweep(retention time.Duration, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if n := p.PurgeDeleted(time.Now().Add(-retention)); n > 0 {
+			log.Printf("%d buckets purged from trash\n", n)
+		}
 	}
-	return nil
 }
@@ -0,0 +1,55 @@
+package pool
+
+import (
+	"bktfile"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// 池中文件的统计，分别按文件、桶大小和桶目录汇总
+type Stats struct {
+	Total   bktfile.Stats
+	Files   map[string]bktfile.Stats // 文件id
+	Sizes   map[string]bktfile.Stats // 桶大小
+	Buckets map[string]bktfile.Stats // 桶目录id
+}
+
+// 统计所有挂载的文件
+func (p *Pool) Stats() (*Stats, error) {
+	stats := &Stats{
+		Files:   make(map[string]bktfile.Stats),
+		Sizes:   make(map[string]bktfile.Stats),
+		Buckets: make(map[string]bktfile.Stats),
+	}
+	for _, f := range p.allFiles() {
+		s, err := f.file.Stats()
+		if err != nil {
+			return nil, err
+		}
+		stats.Files[f.id] = s
+		stats.Total.Merge(s)
+
+		size := strconv.FormatInt(int64(f.file.FileHeader().BucketSize), 10)
+		sizeStats := stats.Sizes[size]
+		sizeStats.Merge(s)
+		stats.Sizes[size] = sizeStats
+
+		if sep := strings.LastIndex(f.id, ":"); sep != -1 {
+			bid := f.id[:sep]
+			bucketStats := stats.Buckets[bid]
+			bucketStats.Merge(s)
+			stats.Buckets[bid] = bucketStats
+		}
+	}
+	return stats, nil
+}
+
+// 统计一个挂载的文件
+func (p *Pool) FileStats(id string) (bktfile.Stats, error) {
+	f := p.GetFile(id)
+	if f == nil {
+		return bktfile.Stats{}, errors.New("no such file")
+	}
+	return f.file.Stats()
+}